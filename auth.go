@@ -0,0 +1,394 @@
+package skv
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+
+	"github.com/Al0ha0e/skv/storage"
+	"github.com/Al0ha0e/skv/transaction"
+)
+
+var (
+	ErrAuthFailed      = errors.New("authentication failed")
+	ErrUnauthenticated = errors.New("authentication required")
+	ErrPermission      = errors.New("permission denied")
+	ErrBadUserName     = errors.New("bad user name")
+	ErrNoUser          = errors.New("no such user")
+)
+
+// Perm is a set of permissions on the keys under a prefix.
+type Perm uint8
+
+const (
+	PermRead Perm = 1 << iota
+	PermWrite
+	// PermAdmin grants reading and writing, and is needed on top of them for
+	// the keys of users and tokens, which are kept under authPrefix
+	PermAdmin
+)
+
+// Grant gives Perms on every key starting with Prefix.
+type Grant struct {
+	Prefix string
+	Perms  Perm
+}
+
+// User is an authenticated client and what it may do.
+type User struct {
+	Name   string
+	Grants []Grant
+}
+
+const (
+	authPrefix     = "\x00skv/"
+	userPrefix     = authPrefix + "user/"
+	tokenPrefix    = authPrefix + "token/"
+	passwordRounds = 10000
+)
+
+// userRecord is how a user is stored, under userPrefix and its name.
+type userRecord struct {
+	Name   string
+	Salt   []byte
+	Hash   []byte
+	Grants []Grant
+	Tokens []string // hashes of the tokens of the user
+}
+
+// Can tells whether u holds perm on key, with the grants of every prefix of
+// key put together.
+func (u *User) Can(key []byte, perm Perm) bool {
+	granted := Perm(0)
+	for _, grant := range u.Grants {
+		if bytes.HasPrefix(key, []byte(grant.Prefix)) {
+			granted |= grant.Perms
+		}
+	}
+	if granted&PermAdmin != 0 {
+		granted |= PermRead | PermWrite
+	}
+	if bytes.HasPrefix(key, []byte(authPrefix)) {
+		perm |= PermAdmin
+	}
+	return granted&perm == perm
+}
+
+// authorize checks that user holds perm on key. A nil user is not checked,
+// which is how the server runs when authentication is not required.
+func authorize(user *User, key []byte, perm Perm) error {
+	if user != nil && !user.Can(key, perm) {
+		return ErrPermission
+	}
+	return nil
+}
+
+// hashPassword derives the hash of password with PBKDF2-HMAC-SHA256, slow
+// enough to make guessing passwords from a leaked hash costly.
+func hashPassword(password string, salt []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(password))
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	hash := append([]byte{}, u...)
+	for i := 1; i < passwordRounds; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range hash {
+			hash[j] ^= u[j]
+		}
+	}
+	return hash
+}
+
+// hashToken hashes a token to the name it is stored under. Tokens are
+// random, a fast hash is enough for them.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// getUser reads the record of the user name, locking it for an update unless
+// tx only reads.
+func getUser(ctx context.Context, tx transaction.Transaction, name string, forUpdate bool) (*userRecord, error) {
+	get := tx.Get
+	if forUpdate {
+		get = tx.GetForUpdate
+	}
+	value, err := get(ctx, []byte(userPrefix+name))
+	if err != nil || value == nil {
+		return nil, err
+	}
+	var record userRecord
+	if err = gob.NewDecoder(bytes.NewReader(value)).Decode(&record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func putUser(ctx context.Context, tx transaction.Transaction, record *userRecord) error {
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(record); err != nil {
+		return err
+	}
+	return tx.Put(ctx, []byte(userPrefix+record.Name), buf.Bytes())
+}
+
+// SetUser creates the user name, or replaces its password and grants,
+// keeping its tokens.
+func (db *DB) SetUser(name string, password string, grants []Grant) error {
+	if name == "" {
+		return ErrBadUserName
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	hash := hashPassword(password, salt)
+	return db.Update(func(tx transaction.Transaction) error {
+		ctx := context.Background()
+		record, err := getUser(ctx, tx, name, true)
+		if err != nil {
+			return err
+		}
+		if record == nil {
+			record = &userRecord{Name: name}
+		}
+		record.Salt = salt
+		record.Hash = hash
+		record.Grants = grants
+		return putUser(ctx, tx, record)
+	})
+}
+
+// DeleteUser deletes the user name along with its tokens.
+func (db *DB) DeleteUser(name string) error {
+	return db.Update(func(tx transaction.Transaction) error {
+		ctx := context.Background()
+		record, err := getUser(ctx, tx, name, true)
+		if err != nil {
+			return err
+		}
+		if record == nil {
+			return ErrNoUser
+		}
+		for _, token := range record.Tokens {
+			if err = tx.Delete(ctx, []byte(tokenPrefix+token)); err != nil {
+				return err
+			}
+		}
+		return tx.Delete(ctx, []byte(userPrefix+name))
+	})
+}
+
+// NewToken issues a token the user name can authenticate with instead of
+// its password. Only its hash is stored, the token cannot be shown again.
+func (db *DB) NewToken(name string) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+	err := db.Update(func(tx transaction.Transaction) error {
+		ctx := context.Background()
+		record, err := getUser(ctx, tx, name, true)
+		if err != nil {
+			return err
+		}
+		if record == nil {
+			return ErrNoUser
+		}
+		record.Tokens = append(record.Tokens, hashToken(token))
+		if err = putUser(ctx, tx, record); err != nil {
+			return err
+		}
+		return tx.Put(ctx, []byte(tokenPrefix+hashToken(token)), []byte(name))
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// RevokeToken makes token unusable.
+func (db *DB) RevokeToken(token string) error {
+	hash := hashToken(token)
+	return db.Update(func(tx transaction.Transaction) error {
+		ctx := context.Background()
+		name, err := tx.GetForUpdate(ctx, []byte(tokenPrefix+hash))
+		if err != nil || name == nil {
+			return err
+		}
+		record, err := getUser(ctx, tx, string(name), true)
+		if err != nil {
+			return err
+		}
+		if record != nil {
+			for i, token := range record.Tokens {
+				if token == hash {
+					record.Tokens = append(record.Tokens[:i], record.Tokens[i+1:]...)
+					break
+				}
+			}
+			if err = putUser(ctx, tx, record); err != nil {
+				return err
+			}
+		}
+		return tx.Delete(ctx, []byte(tokenPrefix+hash))
+	})
+}
+
+// Authenticate returns the user name if password is its password.
+func (db *DB) Authenticate(name string, password string) (*User, error) {
+	var user *User
+	err := db.View(func(tx transaction.Transaction) error {
+		record, err := getUser(context.Background(), tx, name, false)
+		if err != nil {
+			return err
+		}
+		if record == nil {
+			// take as long as for a user that exists
+			hashPassword(password, nil)
+			return ErrAuthFailed
+		}
+		if subtle.ConstantTimeCompare(hashPassword(password, record.Salt), record.Hash) != 1 {
+			return ErrAuthFailed
+		}
+		user = &User{Name: record.Name, Grants: record.Grants}
+		return nil
+	})
+	return user, err
+}
+
+// AuthenticateToken returns the user token was issued to.
+func (db *DB) AuthenticateToken(token string) (*User, error) {
+	var user *User
+	err := db.View(func(tx transaction.Transaction) error {
+		ctx := context.Background()
+		name, err := tx.Get(ctx, []byte(tokenPrefix+hashToken(token)))
+		if err != nil {
+			return err
+		}
+		if name == nil {
+			return ErrAuthFailed
+		}
+		record, err := getUser(ctx, tx, string(name), false)
+		if err != nil {
+			return err
+		}
+		if record == nil {
+			return ErrAuthFailed
+		}
+		user = &User{Name: record.Name, Grants: record.Grants}
+		return nil
+	})
+	return user, err
+}
+
+// guardedTx checks the permissions of user on the keys read and written
+// through it. Scans skip the keys user may not read.
+type guardedTx struct {
+	transaction.Transaction
+	user *User
+}
+
+// guard returns tx, checked against the permissions of user if it is not
+// nil.
+func guard(tx transaction.Transaction, user *User) transaction.Transaction {
+	if user == nil {
+		return tx
+	}
+	return guardedTx{Transaction: tx, user: user}
+}
+
+func (tx guardedTx) Get(ctx context.Context, key []byte) ([]byte, error) {
+	if err := authorize(tx.user, key, PermRead); err != nil {
+		return nil, err
+	}
+	return tx.Transaction.Get(ctx, key)
+}
+
+func (tx guardedTx) GetForUpdate(ctx context.Context, key []byte) ([]byte, error) {
+	if err := authorize(tx.user, key, PermRead); err != nil {
+		return nil, err
+	}
+	return tx.Transaction.GetForUpdate(ctx, key)
+}
+
+func (tx guardedTx) Put(ctx context.Context, key []byte, value []byte) error {
+	if err := authorize(tx.user, key, PermWrite); err != nil {
+		return err
+	}
+	return tx.Transaction.Put(ctx, key, value)
+}
+
+func (tx guardedTx) Increase32(ctx context.Context, key []byte, value int32) error {
+	if err := authorize(tx.user, key, PermRead|PermWrite); err != nil {
+		return err
+	}
+	return tx.Transaction.Increase32(ctx, key, value)
+}
+
+func (tx guardedTx) PutBatch(ctx context.Context, kvs []storage.KV) error {
+	for _, kv := range kvs {
+		if err := authorize(tx.user, kv.Key, PermWrite); err != nil {
+			return err
+		}
+	}
+	return tx.Transaction.PutBatch(ctx, kvs)
+}
+
+func (tx guardedTx) Delete(ctx context.Context, key []byte) error {
+	if err := authorize(tx.user, key, PermWrite); err != nil {
+		return err
+	}
+	return tx.Transaction.Delete(ctx, key)
+}
+
+func (tx guardedTx) Scan(ctx context.Context, start []byte, end []byte) ([]storage.KV, error) {
+	kvs, err := tx.Transaction.Scan(ctx, start, end)
+	return tx.readable(kvs), err
+}
+
+// ScanLimit scans on past the keys user may not read, until it has limit
+// pairs or the range is done.
+func (tx guardedTx) ScanLimit(ctx context.Context, start []byte, end []byte, limit int) ([]storage.KV, error) {
+	if limit <= 0 {
+		return tx.Scan(ctx, start, end)
+	}
+	ret := make([]storage.KV, 0, limit)
+	for {
+		want := limit - len(ret)
+		kvs, err := tx.Transaction.ScanLimit(ctx, start, end, want)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, tx.readable(kvs)...)
+		if len(ret) == limit || len(kvs) < want {
+			return ret, nil
+		}
+		start = append(append([]byte{}, kvs[len(kvs)-1].Key...), 0)
+	}
+}
+
+func (tx guardedTx) PrefixScan(ctx context.Context, prefix []byte) ([]storage.KV, error) {
+	kvs, err := tx.Transaction.PrefixScan(ctx, prefix)
+	return tx.readable(kvs), err
+}
+
+func (tx guardedTx) readable(kvs []storage.KV) []storage.KV {
+	ret := make([]storage.KV, 0, len(kvs))
+	for _, kv := range kvs {
+		if tx.user.Can(kv.Key, PermRead) {
+			ret = append(ret, kv)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,102 @@
+package skv
+
+import (
+	"os"
+	"testing"
+)
+
+func TestUserCan(t *testing.T) {
+	user := &User{
+		Name: "u",
+		Grants: []Grant{
+			{Prefix: "app/", Perms: PermRead},
+			{Prefix: "app/own/", Perms: PermWrite},
+			{Prefix: "admin/", Perms: PermAdmin},
+		},
+	}
+	cases := []struct {
+		key  string
+		perm Perm
+		can  bool
+	}{
+		{"app/a", PermRead, true},
+		{"app/a", PermWrite, false},
+		{"app/own/a", PermRead | PermWrite, true},
+		{"other", PermRead, false},
+		{"admin/a", PermRead | PermWrite, true},
+		{userPrefix + "u", PermRead, false},
+	}
+	for _, c := range cases {
+		if user.Can([]byte(c.key), c.perm) != c.can {
+			t.Error("bad permission", c.key, c.perm, c.can)
+		}
+	}
+
+	root := &User{Name: "root", Grants: []Grant{{Prefix: "", Perms: PermAdmin}}}
+	if !root.Can([]byte(userPrefix+"u"), PermRead) {
+		t.Error("admin cannot read users")
+	}
+	reader := &User{Name: "reader", Grants: []Grant{{Prefix: "", Perms: PermRead}}}
+	if reader.Can([]byte(tokenPrefix+"t"), PermRead) {
+		t.Error("tokens readable without admin")
+	}
+}
+
+func TestUsers(t *testing.T) {
+	os.Remove("./testdata/users.skv")
+	db, err := Open("./testdata/users.skv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	grants := []Grant{{Prefix: "a/", Perms: PermRead}}
+	if err = db.SetUser("alice", "secret", grants); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.SetUser("", "secret", nil); err != ErrBadUserName {
+		t.Fatal("empty user name accepted", err)
+	}
+	user, err := db.Authenticate("alice", "secret")
+	if err != nil || user.Name != "alice" || len(user.Grants) != 1 {
+		t.Fatal("authentication failed", user, err)
+	}
+	if _, err = db.Authenticate("alice", "wrong"); err != ErrAuthFailed {
+		t.Fatal("wrong password accepted", err)
+	}
+	if _, err = db.Authenticate("bob", "secret"); err != ErrAuthFailed {
+		t.Fatal("unknown user accepted", err)
+	}
+
+	token, err := db.NewToken("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.NewToken("bob"); err != ErrNoUser {
+		t.Fatal("token issued to unknown user", err)
+	}
+	// changing the password keeps the tokens
+	if err = db.SetUser("alice", "other", grants); err != nil {
+		t.Fatal(err)
+	}
+	if user, err = db.AuthenticateToken(token); err != nil || user.Name != "alice" {
+		t.Fatal("token authentication failed", user, err)
+	}
+	if err = db.RevokeToken(token); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.AuthenticateToken(token); err != ErrAuthFailed {
+		t.Fatal("revoked token accepted", err)
+	}
+
+	token, _ = db.NewToken("alice")
+	if err = db.DeleteUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.AuthenticateToken(token); err != ErrAuthFailed {
+		t.Fatal("token of deleted user accepted", err)
+	}
+	if _, err = db.Authenticate("alice", "other"); err != ErrAuthFailed {
+		t.Fatal("deleted user accepted", err)
+	}
+}
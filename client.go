@@ -2,19 +2,36 @@ package skv
 
 import (
 	"bufio"
-	"bytes"
-	"encoding/binary"
-	"encoding/gob"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+
+	"github.com/Al0ha0e/skv/transaction"
 )
 
+var ErrNotConnected = errors.New("not connected")
+
+// TesterClient talks to a TesterServer. With the binary protocol requests
+// can be pipelined: Go sends a request without waiting for the replies to
+// earlier ones, which a reader goroutine hands out by request id as they
+// come, in whatever order the server sends them.
 type TesterClient struct {
-	url  string
-	conn net.Conn
+	url       string
+	conn      net.Conn
+	nextID    uint32
+	Protocol  Protocol
+	TLSConfig *tls.Config // connects over TLS when set, see ClientTLSConfig
+	pending   map[uint32]chan OperationResult
+	order     []<-chan OperationResult // replies awaited by Recv, in sending order
+	err       error                    // why the connection broke, if it did
+	received  chan struct{}            // closed once the reader goroutine is gone
+	lock      sync.Mutex
+	write     sync.Mutex // held while a request is written
 }
 
 func MakeTestClient(url string) *TesterClient {
@@ -23,15 +40,114 @@ func MakeTestClient(url string) *TesterClient {
 	}
 }
 
-func (tc *TesterClient) SendPacked(pack Operation) error {
-	buf := &bytes.Buffer{}
-	enc := gob.NewEncoder(buf)
-	enc.Encode(pack)
-	_, err := tc.conn.Write(buf.Bytes())
-	if err != nil {
-		return err
+// failed is the result of a request that got no reply.
+func failed(id uint32, err error) OperationResult {
+	return OperationResult{
+		ID:      id,
+		Code:    errorCode(err),
+		Message: err.Error(),
+	}
+}
+
+// Go sends pack and returns the channel its result will be delivered on.
+func (tc *TesterClient) Go(pack Operation) <-chan OperationResult {
+	ch := make(chan OperationResult, 1)
+	if tc.conn == nil {
+		ch <- failed(0, ErrNotConnected)
+		return ch
 	}
 
+	if tc.Protocol == ProtocolLegacy {
+		// the legacy protocol has no ids, replies come back in order
+		if err := writeRequest(tc.conn, tc.Protocol, pack); err != nil {
+			ch <- failed(0, err)
+			return ch
+		}
+		res, err := readResponse(tc.conn, tc.Protocol)
+		if err != nil {
+			res = failed(0, err)
+		}
+		ch <- res
+		return ch
+	}
+
+	// requests go out in the order of their ids, while replies keep being
+	// received during the write
+	tc.write.Lock()
+	defer tc.write.Unlock()
+	tc.lock.Lock()
+	tc.nextID++
+	pack.ID = tc.nextID
+	if tc.err != nil {
+		tc.lock.Unlock()
+		ch <- failed(pack.ID, tc.err)
+		return ch
+	}
+	tc.pending[pack.ID] = ch
+	tc.lock.Unlock()
+
+	if err := writeRequest(tc.conn, tc.Protocol, pack); err != nil {
+		tc.lock.Lock()
+		// unless the reader failed the request already
+		if _, has := tc.pending[pack.ID]; has {
+			delete(tc.pending, pack.ID)
+			ch <- failed(pack.ID, err)
+		}
+		tc.lock.Unlock()
+	}
+	return ch
+}
+
+// Pipeline sends all of packs at once, then waits for their results.
+func (tc *TesterClient) Pipeline(packs []Operation) []OperationResult {
+	chs := make([]<-chan OperationResult, 0, len(packs))
+	for _, pack := range packs {
+		chs = append(chs, tc.Go(pack))
+	}
+	ret := make([]OperationResult, 0, len(packs))
+	for _, ch := range chs {
+		ret = append(ret, <-ch)
+	}
+	return ret
+}
+
+// receive hands the replies read from conn to the requests awaiting them.
+func (tc *TesterClient) receive(conn net.Conn) {
+	defer close(tc.received)
+	for {
+		res, err := readResponse(conn, tc.Protocol)
+		if err == nil && res.ID == 0 && res.State&2 == 0 {
+			// no request has id 0, the server turned the connection down,
+			// see ErrOverloaded
+			err = res.Err()
+		}
+		tc.lock.Lock()
+		if err != nil {
+			tc.err = err
+			for id, ch := range tc.pending {
+				ch <- failed(id, err)
+			}
+			tc.pending = make(map[uint32]chan OperationResult)
+			tc.lock.Unlock()
+			return
+		}
+		if ch, has := tc.pending[res.ID]; has {
+			delete(tc.pending, res.ID)
+			ch <- res
+		}
+		tc.lock.Unlock()
+	}
+}
+
+func (tc *TesterClient) SendPacked(pack Operation) error {
+	if tc.conn == nil {
+		return ErrNotConnected
+	}
+	if tc.Protocol == ProtocolLegacy {
+		return writeRequest(tc.conn, tc.Protocol, pack)
+	}
+	ch := tc.Go(pack)
+	tc.order = append(tc.order, ch)
 	return nil
 }
 
@@ -44,10 +160,36 @@ func (tc *TesterClient) Send(op OPType, key string, value int32) error {
 	return tc.SendPacked(pack)
 }
 
+// SendData sends an operation carrying an arbitrary value, which needs the
+// binary protocol.
+func (tc *TesterClient) SendData(op OPType, key string, data []byte) error {
+	if data == nil {
+		data = []byte{}
+	}
+	pack := Operation{
+		OP:   op,
+		Key:  key,
+		Data: data,
+	}
+	return tc.SendPacked(pack)
+}
+
+// Recv returns the result of the oldest request sent by SendPacked that was
+// not received yet.
 func (tc *TesterClient) Recv() OperationResult {
-	pack := OperationResult{}
-	binary.Read(tc.conn, binary.BigEndian, &pack)
-	return pack
+	if tc.Protocol == ProtocolLegacy {
+		if tc.conn == nil {
+			return failed(0, ErrNotConnected)
+		}
+		pack, _ := readResponse(tc.conn, tc.Protocol)
+		return pack
+	}
+	if len(tc.order) == 0 {
+		return OperationResult{}
+	}
+	ch := tc.order[0]
+	tc.order = tc.order[1:]
+	return <-ch
 }
 
 func (tc *TesterClient) OperatePacked(pack Operation) OperationResult {
@@ -60,12 +202,59 @@ func (tc *TesterClient) Operate(op OPType, key string, value int32) OperationRes
 	return tc.Recv()
 }
 
+func (tc *TesterClient) OperateData(op OPType, key string, data []byte) OperationResult {
+	tc.SendData(op, key, data)
+	return tc.Recv()
+}
+
+// Auth authenticates the connection as the user name, which servers
+// requiring authentication expect before any other request. A failed
+// attempt closes the connection.
+func (tc *TesterClient) Auth(name string, password string) error {
+	res := <-tc.Go(Operation{OP: OPAUTH, Key: name, Data: []byte(password)})
+	return res.Err()
+}
+
+// AuthToken authenticates the connection with a token, see DB.NewToken.
+func (tc *TesterClient) AuthToken(token string) error {
+	return tc.Auth("", token)
+}
+
+// Begin opens a transaction behind a handle, with the options OPTXSTART
+// takes in its value, so that several of them can run over the connection.
+func (tc *TesterClient) Begin(value int32) (uint32, error) {
+	res := <-tc.Go(Operation{OP: OPTXSTART, Flags: FlagNewTx, Value: value})
+	if err := res.Err(); err != nil {
+		return 0, err
+	}
+	return res.Tx, nil
+}
+
+// OperateTx runs an operation in the transaction of handle tx.
+func (tc *TesterClient) OperateTx(tx uint32, op OPType, key string, value int32) OperationResult {
+	return <-tc.Go(Operation{Tx: tx, OP: op, Key: key, Value: value})
+}
+
 func (tc *TesterClient) Run() error {
-	conn, err := net.Dial("tcp", tc.url)
+	var conn net.Conn
+	var err error
+	if tc.TLSConfig != nil {
+		conn, err = tls.Dial("tcp", tc.url, tc.TLSConfig)
+	} else {
+		conn, err = net.Dial("tcp", tc.url)
+	}
 	if err != nil {
 		return err
 	}
 	tc.conn = conn
+	tc.pending = make(map[uint32]chan OperationResult)
+	tc.order = nil
+	tc.err = nil
+	tc.received = nil
+	if tc.Protocol != ProtocolLegacy {
+		tc.received = make(chan struct{})
+		go tc.receive(conn)
+	}
 	// defer tc.conn.Close()
 
 	// for i := 0; i < 1000; i++ {
@@ -77,9 +266,19 @@ func (tc *TesterClient) Run() error {
 
 func (tc *TesterClient) Stop() {
 	tc.conn.Close()
+	if tc.received != nil {
+		<-tc.received
+	}
 	tc.conn = nil
 }
 
+var isolationNames = map[string]transaction.IsolationLevel{
+	"SERIALIZABLE":    transaction.IsolationSerializable,
+	"REPEATABLE_READ": transaction.IsolationRepeatableRead,
+	"READ_COMMITTED":  transaction.IsolationReadCommitted,
+	"SNAPSHOT":        transaction.IsolationSnapshot,
+}
+
 func ParseCase(path string) []Operation {
 	ret := make([]Operation, 0)
 
@@ -103,6 +302,13 @@ func ParseCase(path string) []Operation {
 
 		if op == "BEGIN" {
 			opi = OPTXSTART
+			for _, f := range fields[1:] {
+				if f == "READ_ONLY" {
+					value |= TxFlagReadOnly
+				} else {
+					value |= int32(isolationNames[f])
+				}
+			}
 		} else if op == "COMMIT" {
 			opi = OPCOMMIT
 		} else if op == "ABORT" {
@@ -132,6 +338,10 @@ func ParseCase(path string) []Operation {
 					v, _ := strconv.ParseInt(f, 10, 32)
 					value = int32(v)
 				}
+			} else if op == "SAVEPOINT" {
+				opi = OPSAVEPOINT
+			} else if op == "ROLLBACK" {
+				opi = OPROLLBACKTO
 			} else {
 				opi = OPDEL
 			}
@@ -2,26 +2,84 @@ package skv
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
+	"math/rand"
+	"strconv"
+	"time"
 
 	"github.com/Al0ha0e/skv/storage"
 	"github.com/Al0ha0e/skv/transaction"
 )
 
+var (
+	ErrNotInteger = errors.New("value is not an integer or out of range")
+	ErrOverflow   = errors.New("increment or decrement would overflow")
+)
+
 type DB struct {
 	store storage.Storage
 	lm    *transaction.LockManager
+	mvcc  *transaction.MVCCLockManager
+	hooks *transaction.Hooks
+	opts  Options
+}
+
+type Options struct {
+	LockPolicy        transaction.LockPolicy
+	LockTimeout       time.Duration
+	TxTimeout         time.Duration
+	LockSeparator     string
+	LockEscalateAfter int
+	MaxAttempts       int           // runs of an Update or View function, 0 or 1 never retries
+	RetryBackoff      time.Duration // wait before the first retry, doubled after each one
+	MaxRetryBackoff   time.Duration
+	Retention         uint64 // commit timestamps of history kept for reads in the past
+}
+
+func DefaultOptions() Options {
+	return Options{
+		LockPolicy:        transaction.LockPolicyNoWait,
+		LockTimeout:       0,
+		TxTimeout:         0,
+		LockSeparator:     "",
+		LockEscalateAfter: 0,
+		MaxAttempts:       10,
+		RetryBackoff:      time.Millisecond,
+		MaxRetryBackoff:   100 * time.Millisecond,
+		Retention:         10000,
+	}
 }
 
 func Open(path string) (*DB, error) {
-	store, err := storage.OpenBitcask(path)
+	return OpenWithOptions(path, DefaultOptions())
+}
+
+func OpenWithOptions(path string, opts Options) (*DB, error) {
+	store, err := storage.OpenBitcaskWithRetention(path, opts.Retention)
 	if err != nil {
 		return nil, err
 	}
 
+	lm := transaction.MakeLockManager(opts.LockPolicy)
+	lm.LockTimeout = opts.LockTimeout
+	lm.TxTimeout = opts.TxTimeout
+	lm.Separator = opts.LockSeparator
+	lm.EscalateAfter = opts.LockEscalateAfter
+	mvcc := transaction.MakeMVCCLockManager(store)
+	mvcc.Writers = lm
+	lm.Versions = mvcc
+	hooks := &transaction.Hooks{}
+	lm.Hooks = hooks
+	mvcc.Hooks = hooks
+
 	ret := &DB{
 		store: store,
-		lm:    transaction.MakeLockManager(),
+		lm:    lm,
+		mvcc:  mvcc,
+		hooks: hooks,
+		opts:  opts,
 	}
 	return ret, nil
 }
@@ -32,13 +90,51 @@ func (db *DB) Get(key []byte) (value []byte, err error) {
 	return db.store.Get(key)
 }
 
-func (db *DB) Put(key []byte, value []byte) (err error) {
+// OnPreCommit registers a hook run before every transaction commits, but
+// read-only ones. Any error it returns aborts the transaction.
+func (db *DB) OnPreCommit(fn transaction.PreCommitHook) {
+	db.hooks.OnPreCommit(fn)
+}
+
+// OnPostCommit registers a hook run after every transaction commits, with the
+// keys the transaction wrote. Writes made outside of transactions by Put,
+// Delete and Increase32 do not run hooks.
+func (db *DB) OnPostCommit(fn transaction.PostCommitHook) {
+	db.hooks.OnPostCommit(fn)
+}
+
+// GetAt returns the value key had at timestamp ts, which must lie within the
+// retention window.
+func (db *DB) GetAt(key []byte, ts uint64) (value []byte, err error) {
+	if ts > db.LastTS() {
+		return nil, transaction.ErrFutureTS
+	}
 	db.store.Lock()
 	defer db.store.Unlock()
-	return db.store.Put(key, value)
+	return db.store.GetAt(key, ts)
+}
+
+// LastTS returns the timestamp of the latest commit. Transactions starting
+// do not move it, so GetAt only reads history no commit can still change.
+func (db *DB) LastTS() uint64 {
+	return db.mvcc.LastTS()
+}
+
+func (db *DB) Put(key []byte, value []byte) (err error) {
+	return db.mvcc.Install([][]byte{key}, func(ts uint64) error {
+		db.store.Lock()
+		defer db.store.Unlock()
+		return db.store.PutBatchAt(ts, []storage.KV{{Key: key, Value: value}})
+	})
 }
 
 func (db *DB) Increase32(key []byte, inc int32) (err error) {
+	return db.mvcc.Install([][]byte{key}, func(ts uint64) error {
+		return db.increase32(key, inc, ts)
+	})
+}
+
+func (db *DB) increase32(key []byte, inc int32, ts uint64) (err error) {
 	db.store.Lock()
 	defer db.store.Unlock()
 	value, err := db.store.Get(key)
@@ -54,17 +150,142 @@ func (db *DB) Increase32(key []byte, inc int32) (err error) {
 	}
 	buf := &bytes.Buffer{}
 	binary.Write(buf, binary.BigEndian, ivalue+inc)
-	return db.store.Put(key, buf.Bytes())
+	return db.store.PutBatchAt(ts, []storage.KV{{Key: key, Value: buf.Bytes()}})
+}
+
+// increaseDecimal adds inc to the integer stored in decimal at key, as the
+// Redis and HTTP front ends keep counters, returning the new value.
+// Increase32 works on 4-byte integers instead.
+func increaseDecimal(ctx context.Context, tx transaction.Transaction, key []byte, inc int64) (int64, error) {
+	value, err := tx.GetForUpdate(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	n := int64(0)
+	if value != nil {
+		n, err = strconv.ParseInt(string(value), 10, 64)
+		if err != nil {
+			return 0, ErrNotInteger
+		}
+	}
+	if (inc > 0 && n > n+inc) || (inc < 0 && n < n+inc) {
+		return 0, ErrOverflow
+	}
+	n += inc
+	return n, tx.Put(ctx, key, []byte(strconv.FormatInt(n, 10)))
 }
 
 func (db *DB) Delete(key []byte) (err error) {
-	db.store.Lock()
-	defer db.store.Unlock()
-	return db.store.Delete(key)
+	return db.mvcc.Install([][]byte{key}, func(ts uint64) error {
+		db.store.Lock()
+		defer db.store.Unlock()
+		return db.store.PutBatchAt(ts, []storage.KV{{Key: key, Value: nil}})
+	})
 }
 
-func (db *DB) StartTransaction() transaction.Transaction {
-	return db.lm.MakeTwoPLInstance(db.store)
+func (db *DB) StartTransaction(opts transaction.TxOptions) (transaction.Transaction, error) {
+	if opts.ReadOnly && opts.AsOf != 0 {
+		tx, err := db.mvcc.MakeReadOnlyInstanceAt(opts.AsOf)
+		if err != nil {
+			return nil, err
+		}
+		return tx, nil
+	}
+	if opts.ReadOnly {
+		tx, err := db.mvcc.MakeReadOnlyInstance()
+		if err != nil {
+			return nil, err
+		}
+		return tx, nil
+	}
+
+	switch opts.Isolation {
+	case transaction.IsolationSerializable,
+		transaction.IsolationRepeatableRead,
+		transaction.IsolationReadCommitted:
+		tx := db.lm.MakeTwoPLInstance(db.store)
+		tx.Isolation = opts.Isolation
+		return tx, nil
+	case transaction.IsolationSnapshot:
+		tx, err := db.mvcc.MakeMVCCInstance(db.store)
+		if err != nil {
+			return nil, err
+		}
+		return tx, nil
+	}
+	return nil, transaction.ErrBadIsolation
+}
+
+// Update runs fn in a serializable transaction, committing it if fn returns
+// nil and aborting it otherwise. When the transaction is aborted by a
+// conflict with another one, fn is run again in a new transaction that keeps
+// the age of the first, up to MaxAttempts times.
+func (db *DB) Update(fn func(tx transaction.Transaction) error) error {
+	var ts uint64
+	return db.retry(func() error {
+		var tx *transaction.TwoPLInstance
+		if ts == 0 {
+			tx = db.lm.MakeTwoPLInstance(db.store)
+			ts = tx.TS
+		} else {
+			tx = db.lm.MakeTwoPLInstanceAt(db.store, ts)
+		}
+		return runTx(tx, fn)
+	})
+}
+
+// View runs fn in a read-only transaction.
+func (db *DB) View(fn func(tx transaction.Transaction) error) error {
+	return db.retry(func() error {
+		tx, err := db.mvcc.MakeReadOnlyInstance()
+		if err != nil {
+			return err
+		}
+		return runTx(tx, fn)
+	})
+}
+
+func (db *DB) retry(attempt func() error) (err error) {
+	backoff := db.opts.RetryBackoff
+	for i := 1; ; i++ {
+		err = attempt()
+		if i >= db.opts.MaxAttempts || !transaction.Retryable(err) {
+			return err
+		}
+		if backoff > 0 {
+			// jitter keeps the conflicting transactions from retrying in step
+			time.Sleep(backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1)))
+			backoff *= 2
+			if db.opts.MaxRetryBackoff > 0 && backoff > db.opts.MaxRetryBackoff {
+				backoff = db.opts.MaxRetryBackoff
+			}
+		}
+	}
+}
+
+// runTx runs fn in tx, aborting tx if fn fails or panics. A panic is passed
+// on once the transaction's locks are released.
+func runTx(tx transaction.Transaction, fn func(tx transaction.Transaction) error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Abort()
+			panic(r)
+		}
+	}()
+
+	if err = fn(tx); err != nil {
+		// the transaction may already be aborted by the failed operation
+		tx.Abort()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Merge compacts the log, dropping versions older than the retention window.
+func (db *DB) Merge() error {
+	db.store.Lock()
+	defer db.store.Unlock()
+	return db.store.Merge()
 }
 
 func (db *DB) Close() {
@@ -0,0 +1,182 @@
+package skv
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/Al0ha0e/skv/storage"
+	"github.com/Al0ha0e/skv/transaction"
+)
+
+var ctx = context.Background()
+
+func openTestDB(t *testing.T, path string, opts Options) *DB {
+	os.Remove(path)
+	db, err := OpenWithOptions(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestUpdateRetry(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MaxAttempts = 1000
+	db := openTestDB(t, "./testdata/update.skv", opts)
+	defer db.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				err := db.Update(func(tx transaction.Transaction) error {
+					return tx.Increase32(ctx, []byte("cnt"), 1)
+				})
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	value, _ := db.Get([]byte("cnt"))
+	var cnt int32
+	binary.Read(bytes.NewBuffer(value), binary.BigEndian, &cnt)
+	if cnt != 40 {
+		t.Fatal("lost updates", cnt)
+	}
+}
+
+func TestUpdateAbort(t *testing.T) {
+	db := openTestDB(t, "./testdata/abort.skv", DefaultOptions())
+	defer db.Close()
+
+	failed := errors.New("failed")
+	runs := 0
+	err := db.Update(func(tx transaction.Transaction) error {
+		runs++
+		tx.Put(ctx, []byte("A"), []byte{1})
+		return failed
+	})
+	if err != failed || runs != 1 {
+		t.Fatal("application error retried", err, runs)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("panic swallowed")
+			}
+		}()
+		db.Update(func(tx transaction.Transaction) error {
+			tx.Put(ctx, []byte("A"), []byte{2})
+			panic("boom")
+		})
+	}()
+
+	err = db.View(func(tx transaction.Transaction) error {
+		value, err := tx.Get(ctx, []byte("A"))
+		if value != nil {
+			t.Error("aborted write visible", value)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Update(func(tx transaction.Transaction) error {
+		return tx.Put(ctx, []byte("A"), []byte{3})
+	}); err != nil {
+		t.Fatal("locks of panicking transaction kept", err)
+	}
+}
+
+func TestRecoverCommitted(t *testing.T) {
+	db := openTestDB(t, "./testdata/recover.skv", DefaultOptions())
+	db.Update(func(tx transaction.Transaction) error {
+		return tx.PutBatch(ctx, []storage.KV{{Key: []byte("A"), Value: []byte{1}}, {Key: []byte("B"), Value: []byte{2}}})
+	})
+	tx, _ := db.StartTransaction(transaction.TxOptions{})
+	tx.Put(ctx, []byte("C"), []byte{3})
+	db.Close()
+
+	db, err := Open("./testdata/recover.skv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if v, _ := db.Get([]byte("B")); !bytes.Equal(v, []byte{2}) {
+		t.Error("committed write lost", v)
+	}
+	if v, _ := db.Get([]byte("C")); v != nil {
+		t.Error("uncommitted write recovered", v)
+	}
+}
+
+func TestTimestampRestored(t *testing.T) {
+	db := openTestDB(t, "./testdata/timestamp.skv", DefaultOptions())
+	db.Put([]byte("A"), []byte{1})
+	db.Update(func(tx transaction.Transaction) error {
+		return tx.Put(ctx, []byte("B"), []byte{2})
+	})
+	last := db.mvcc.CurrTS
+	db.Close()
+
+	db, err := Open("./testdata/timestamp.skv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if db.mvcc.CurrTS != last {
+		t.Fatal("timestamp counter not restored", db.mvcc.CurrTS, last)
+	}
+}
+
+func TestTimeTravel(t *testing.T) {
+	db := openTestDB(t, "./testdata/travel.skv", DefaultOptions())
+	defer db.Close()
+
+	db.Put([]byte("A"), []byte{1})
+	past := db.LastTS()
+	db.Update(func(tx transaction.Transaction) error {
+		return tx.Put(ctx, []byte("A"), []byte{2})
+	})
+
+	if v, _ := db.GetAt([]byte("A"), past); !bytes.Equal(v, []byte{1}) {
+		t.Fatal("bad historical value", v)
+	}
+	if _, err := db.GetAt([]byte("A"), db.LastTS()+1); err != transaction.ErrFutureTS {
+		t.Fatal("read in the future allowed", err)
+	}
+
+	// a snapshot started now commits after the reads at LastTS
+	snap, _ := db.StartTransaction(transaction.TxOptions{Isolation: transaction.IsolationSnapshot})
+	now := db.LastTS()
+	if _, err := db.GetAt([]byte("A"), now+1); err != transaction.ErrFutureTS {
+		t.Fatal("read at a start timestamp allowed", err)
+	}
+	snap.Put(ctx, []byte("A"), []byte{3})
+	if err := snap.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := db.GetAt([]byte("A"), now); !bytes.Equal(v, []byte{2}) {
+		t.Fatal("history changed after it was read", v)
+	}
+
+	tx, err := db.StartTransaction(transaction.TxOptions{ReadOnly: true, AsOf: past})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Commit()
+	if v, _ := tx.Get(ctx, []byte("A")); !bytes.Equal(v, []byte{1}) {
+		t.Fatal("pinned transaction saw a later commit", v)
+	}
+}
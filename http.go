@@ -0,0 +1,560 @@
+package skv
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Al0ha0e/skv/transaction"
+)
+
+// The HTTP API. Keys and values are plain strings unless the request has
+// ?encoding=base64, in which case they are base64 in JSON bodies, and
+// URL-safe base64 without padding in paths.
+//
+//	GET    /kv/{key}                      {"key": ..., "value": ...}
+//	PUT    /kv/{key}   {"value": ...}
+//	DELETE /kv/{key}
+//	GET    /kv?start=&end=&prefix=&limit=&cursor=
+//	                                      {"items": [...], "cursor": ...}
+//	POST   /incr/{key} {"by": n}          {"key": ..., "value": n}
+//	POST   /tx         {"read_only": bool, "ops": [...]}
+//	                                      {"results": [...]}
+//
+// Errors reply {"error": message, "code": ErrorCode}.
+//
+// Requests authenticate with basic authentication, as a user and its
+// password, or with an Authorization: Bearer header carrying a token.
+
+const (
+	httpDefaultLimit = 100
+	httpMaxLimit     = 1000
+	httpMaxBody      = MaxFrameSize
+)
+
+var (
+	errHTTPNotFound = errors.New("key not found")
+	errHTTPMethod   = errors.New("method not allowed")
+)
+
+// httpBadRequest marks errors in the request itself.
+type httpBadRequest struct {
+	error
+}
+
+type httpItem struct {
+	Key   string  `json:"key"`
+	Value *string `json:"value"`
+}
+
+type httpOp struct {
+	Op    string  `json:"op"` // get, put, delete or incr
+	Key   string  `json:"key"`
+	Value *string `json:"value,omitempty"`
+	By    *int64  `json:"by,omitempty"`
+}
+
+// httpOpResult is the value read by a get or the new number of an incr.
+type httpOpResult struct {
+	Value  *string `json:"value"`
+	Number *int64  `json:"number,omitempty"`
+}
+
+type httpTx struct {
+	ReadOnly bool     `json:"read_only"`
+	Ops      []httpOp `json:"ops"`
+}
+
+// httpCodec converts keys and values to and from their JSON form.
+type httpCodec struct {
+	base64 bool
+}
+
+func makeHTTPCodec(r *http.Request) (httpCodec, error) {
+	switch r.URL.Query().Get("encoding") {
+	case "", "text":
+		return httpCodec{}, nil
+	case "base64":
+		return httpCodec{base64: true}, nil
+	}
+	return httpCodec{}, httpBadRequest{errors.New("unknown encoding")}
+}
+
+func (hc httpCodec) encode(b []byte) string {
+	if hc.base64 {
+		return base64.StdEncoding.EncodeToString(b)
+	}
+	return string(b)
+}
+
+func (hc httpCodec) decode(s string) ([]byte, error) {
+	if !hc.base64 {
+		return []byte(s), nil
+	}
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, httpBadRequest{err}
+	}
+	return b, nil
+}
+
+func (hc httpCodec) decodePath(s string) ([]byte, error) {
+	if !hc.base64 {
+		return []byte(s), nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, httpBadRequest{err}
+	}
+	return b, nil
+}
+
+func (hc httpCodec) value(b []byte) *string {
+	if b == nil {
+		return nil
+	}
+	s := hc.encode(b)
+	return &s
+}
+
+func httpStatus(err error) int {
+	switch {
+	case err == errHTTPNotFound:
+		return http.StatusNotFound
+	case err == errHTTPMethod:
+		return http.StatusMethodNotAllowed
+	case transaction.Retryable(err):
+		return http.StatusConflict
+	case err == ErrOverloaded, err == ErrServerClosed:
+		return http.StatusServiceUnavailable
+	case err == ErrAuthFailed, err == ErrUnauthenticated:
+		return http.StatusUnauthorized
+	case err == ErrPermission:
+		return http.StatusForbidden
+	case errors.As(err, &httpBadRequest{}),
+		errors.Is(err, ErrNotInteger),
+		errors.Is(err, ErrOverflow),
+		errors.Is(err, transaction.ErrReadOnlyTx):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeHTTPError(w http.ResponseWriter, err error) {
+	writeJSON(w, httpStatus(err), map[string]interface{}{
+		"error": err.Error(),
+		"code":  errorCode(err),
+	})
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, httpMaxBody))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return httpBadRequest{err}
+	}
+	return nil
+}
+
+func (ts *TesterServer) serveKV(w http.ResponseWriter, r *http.Request) {
+	hc, err := makeHTTPCodec(r)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	path := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/kv"), "/")
+	if path == "" {
+		if r.Method != http.MethodGet {
+			writeHTTPError(w, errHTTPMethod)
+			return
+		}
+		ts.serveList(w, r, hc)
+		return
+	}
+	key, err := hc.decodePath(path)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	perm := PermWrite
+	if r.Method == http.MethodGet {
+		perm = PermRead
+	}
+	if err = authorize(httpUser(r), key, perm); err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		value, err := ts.db.Get(key)
+		if err == nil && value == nil {
+			err = errHTTPNotFound
+		}
+		if err != nil {
+			writeHTTPError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, httpItem{Key: hc.encode(key), Value: hc.value(value)})
+	case http.MethodPut:
+		var item httpItem
+		if err = readJSON(w, r, &item); err != nil {
+			writeHTTPError(w, err)
+			return
+		}
+		if item.Value == nil {
+			writeHTTPError(w, httpBadRequest{errors.New("missing value")})
+			return
+		}
+		value, err := hc.decode(*item.Value)
+		if err == nil {
+			err = ts.db.Put(key, value)
+		}
+		if err != nil {
+			writeHTTPError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		if err = ts.db.Delete(key); err != nil {
+			writeHTTPError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeHTTPError(w, errHTTPMethod)
+	}
+}
+
+// serveList lists the keys in [start, end), or under prefix, in order. The
+// cursor returned with a full page is where the next page starts.
+func (ts *TesterServer) serveList(w http.ResponseWriter, r *http.Request, hc httpCodec) {
+	query := r.URL.Query()
+	start, err := hc.decode(query.Get("start"))
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	var end []byte
+	if query.Get("end") != "" {
+		if end, err = hc.decode(query.Get("end")); err != nil {
+			writeHTTPError(w, err)
+			return
+		}
+	}
+	if query.Get("prefix") != "" {
+		prefix, err := hc.decode(query.Get("prefix"))
+		if err != nil {
+			writeHTTPError(w, err)
+			return
+		}
+		start, end = prefix, transaction.PrefixEnd(prefix)
+	}
+	if query.Get("cursor") != "" {
+		// the cursor is opaque, always URL-safe base64 of the next key
+		start, err = base64.RawURLEncoding.DecodeString(query.Get("cursor"))
+		if err != nil {
+			writeHTTPError(w, httpBadRequest{err})
+			return
+		}
+	}
+	limit := httpDefaultLimit
+	if query.Get("limit") != "" {
+		limit, err = strconv.Atoi(query.Get("limit"))
+		if err != nil || limit <= 0 || limit > httpMaxLimit {
+			writeHTTPError(w, httpBadRequest{errors.New("bad limit")})
+			return
+		}
+	}
+
+	items := make([]httpItem, 0)
+	cursor := ""
+	err = ts.db.View(func(tx transaction.Transaction) error {
+		// one more pair tells whether there is a next page
+		kvs, err := guard(tx, httpUser(r)).ScanLimit(r.Context(), start, end, limit+1)
+		if err != nil {
+			return err
+		}
+		if len(kvs) > limit {
+			next := append(append([]byte{}, kvs[limit-1].Key...), 0)
+			cursor = base64.RawURLEncoding.EncodeToString(next)
+			kvs = kvs[:limit]
+		}
+		for _, kv := range kvs {
+			items = append(items, httpItem{Key: hc.encode(kv.Key), Value: hc.value(kv.Value)})
+		}
+		return nil
+	})
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"items":  items,
+		"cursor": cursor,
+	})
+}
+
+// serveIncr adds to the decimal integer stored at the key, atomically.
+func (ts *TesterServer) serveIncr(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeHTTPError(w, errHTTPMethod)
+		return
+	}
+	hc, err := makeHTTPCodec(r)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	key, err := hc.decodePath(strings.TrimPrefix(r.URL.Path, "/incr/"))
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	body := struct {
+		By *int64 `json:"by"`
+	}{}
+	if r.ContentLength != 0 {
+		if err = readJSON(w, r, &body); err != nil {
+			writeHTTPError(w, err)
+			return
+		}
+	}
+	by := int64(1)
+	if body.By != nil {
+		by = *body.By
+	}
+
+	var n int64
+	err = ts.db.Update(func(tx transaction.Transaction) (err error) {
+		n, err = increaseDecimal(r.Context(), guard(tx, httpUser(r)), key, by)
+		return err
+	})
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"key":   hc.encode(key),
+		"value": n,
+	})
+}
+
+// serveTx runs a batch of operations in one transaction, serializable or
+// read-only. Either all of them take effect or, on the first failing one,
+// none does.
+func (ts *TesterServer) serveTx(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeHTTPError(w, errHTTPMethod)
+		return
+	}
+	hc, err := makeHTTPCodec(r)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	var batch httpTx
+	if err = readJSON(w, r, &batch); err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+
+	var results []httpOpResult
+	run := func(tx transaction.Transaction) error {
+		results = make([]httpOpResult, 0, len(batch.Ops))
+		for i, op := range batch.Ops {
+			res, err := ts.runHTTPOp(r, hc, guard(tx, httpUser(r)), op)
+			if err != nil {
+				if errors.As(err, &httpBadRequest{}) {
+					err = httpBadRequest{errors.New("op " + strconv.Itoa(i) + ": " + err.Error())}
+				}
+				return err
+			}
+			results = append(results, res)
+		}
+		return nil
+	}
+	if batch.ReadOnly {
+		err = ts.db.View(run)
+	} else {
+		err = ts.db.Update(run)
+	}
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"results": results,
+	})
+}
+
+func (ts *TesterServer) runHTTPOp(r *http.Request, hc httpCodec, tx transaction.Transaction, op httpOp) (res httpOpResult, err error) {
+	key, err := hc.decode(op.Key)
+	if err != nil {
+		return res, err
+	}
+
+	ctx := r.Context()
+	switch op.Op {
+	case "get":
+		value, err := tx.Get(ctx, key)
+		res.Value = hc.value(value)
+		return res, err
+	case "put":
+		if op.Value == nil {
+			return res, httpBadRequest{errors.New("missing value")}
+		}
+		value, err := hc.decode(*op.Value)
+		if err != nil {
+			return res, err
+		}
+		return res, tx.Put(ctx, key, value)
+	case "delete":
+		return res, tx.Delete(ctx, key)
+	case "incr":
+		by := int64(1)
+		if op.By != nil {
+			by = *op.By
+		}
+		n, err := increaseDecimal(ctx, tx, key, by)
+		res.Number = &n
+		return res, err
+	}
+	return res, httpBadRequest{errors.New("unknown op " + strconv.Quote(op.Op))}
+}
+
+// HTTPHandler serves the HTTP API of the database.
+func (ts *TesterServer) HTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/kv", ts.serveKV)
+	mux.HandleFunc("/kv/", ts.serveKV)
+	mux.HandleFunc("/incr/", ts.serveIncr)
+	mux.HandleFunc("/tx", ts.serveTx)
+	handler := ts.httpAuth(mux)
+	if ts.MaxConns > 0 {
+		handler = limitHTTP(handler, ts.MaxConns)
+	}
+	return ts.trackHTTP(handler)
+}
+
+// limitHTTP tells clients past max requests at once to come back later.
+func limitHTTP(next http.Handler, max int) http.Handler {
+	slots := make(chan struct{}, max)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case slots <- struct{}{}:
+		default:
+			w.Header().Set("Retry-After", "1")
+			writeHTTPError(w, ErrOverloaded)
+			return
+		}
+		defer func() { <-slots }()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// trackHTTP registers the requests next serves with the server, like its
+// connections, so that Shutdown waits for them before closing the DB, and
+// cancels them when it times out.
+func (ts *TesterServer) trackHTTP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		r = r.WithContext(ctx)
+
+		ts.lock.Lock()
+		if ts.shutdown {
+			ts.lock.Unlock()
+			writeHTTPError(w, ErrServerClosed)
+			return
+		}
+		ts.requests[r] = cancel
+		ts.running.Add(1)
+		ts.lock.Unlock()
+
+		defer func() {
+			ts.lock.Lock()
+			delete(ts.requests, r)
+			ts.lock.Unlock()
+			ts.running.Done()
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+type httpUserKey struct{}
+
+// httpAuth authenticates the requests before next serves them, refusing
+// those without credentials when the server requires authentication.
+func (ts *TesterServer) httpAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var user *User
+		var err error
+		header := r.Header.Get("Authorization")
+		if name, password, ok := r.BasicAuth(); ok {
+			user, err = ts.db.Authenticate(name, password)
+		} else if strings.HasPrefix(header, "Bearer ") {
+			user, err = ts.db.AuthenticateToken(strings.TrimPrefix(header, "Bearer "))
+		} else if ts.RequireAuth {
+			err = ErrUnauthenticated
+		}
+		if err != nil {
+			if err == ErrAuthFailed || err == ErrUnauthenticated {
+				w.Header().Set("WWW-Authenticate", `Basic realm="skv"`)
+			}
+			writeHTTPError(w, err)
+			return
+		}
+		if user != nil {
+			r = r.WithContext(context.WithValue(r.Context(), httpUserKey{}, user))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// httpUser is the user r authenticated as, nil if it did not.
+func httpUser(r *http.Request) *User {
+	user, _ := r.Context().Value(httpUserKey{}).(*User)
+	return user
+}
+
+// RunHTTP serves the HTTP API on url. It can run alongside Run.
+func (ts *TesterServer) RunHTTP(url string) error {
+	ts.lock.Lock()
+	if ts.shutdown {
+		ts.lock.Unlock()
+		return ErrServerClosed
+	}
+	server := &http.Server{
+		Addr:         url,
+		Handler:      ts.HTTPHandler(),
+		ReadTimeout:  ts.ReadTimeout,
+		WriteTimeout: ts.WriteTimeout,
+		IdleTimeout:  ts.IdleTimeout,
+		TLSConfig:    ts.TLSConfig,
+	}
+	ts.httpServer = server
+	ts.lock.Unlock()
+
+	var err error
+	if server.TLSConfig != nil {
+		// the certificates are in TLSConfig already
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err == http.ErrServerClosed {
+		return ErrServerClosed
+	}
+	return err
+}
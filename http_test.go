@@ -0,0 +1,266 @@
+package skv
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Al0ha0e/skv/storage"
+	"github.com/Al0ha0e/skv/transaction"
+)
+
+func doHTTP(t *testing.T, method string, url string, body string, out interface{}) int {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil && resp.StatusCode != http.StatusNoContent {
+		if err = json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestHTTPKeys(t *testing.T) {
+	server := makeTestServer(t, "./testdata/http.skv", "")
+	defer server.Stop()
+	hs := httptest.NewServer(server.HTTPHandler())
+	defer hs.Close()
+
+	if code := doHTTP(t, "PUT", hs.URL+"/kv/a/b", `{"value":"1"}`, nil); code != http.StatusNoContent {
+		t.Fatal("put failed", code)
+	}
+	var item httpItem
+	if code := doHTTP(t, "GET", hs.URL+"/kv/a/b", "", &item); code != http.StatusOK || *item.Value != "1" {
+		t.Fatal("bad get", code, item)
+	}
+
+	key := []byte{0, 0xff, '/'}
+	path := hs.URL + "/kv/" + base64.RawURLEncoding.EncodeToString(key) + "?encoding=base64"
+	doHTTP(t, "PUT", path, `{"value":"AAEC"}`, nil)
+	if value, _ := server.db.Get(key); string(value) != "\x00\x01\x02" {
+		t.Fatal("bad binary value", value)
+	}
+	item = httpItem{}
+	doHTTP(t, "GET", path, "", &item)
+	if item.Key != base64.StdEncoding.EncodeToString(key) || *item.Value != "AAEC" {
+		t.Fatal("bad binary get", item)
+	}
+
+	doHTTP(t, "DELETE", hs.URL+"/kv/a/b", "", nil)
+	var failure struct {
+		Error string
+		Code  ErrorCode
+	}
+	if code := doHTTP(t, "GET", hs.URL+"/kv/a/b", "", &failure); code != http.StatusNotFound {
+		t.Fatal("deleted key found", code)
+	}
+
+	var incr struct{ Value int64 }
+	doHTTP(t, "POST", hs.URL+"/incr/n", "", &incr)
+	doHTTP(t, "POST", hs.URL+"/incr/n", `{"by":41}`, &incr)
+	if incr.Value != 42 {
+		t.Fatal("bad increment", incr)
+	}
+	doHTTP(t, "PUT", hs.URL+"/kv/s", `{"value":"x"}`, nil)
+	if code := doHTTP(t, "POST", hs.URL+"/incr/s", "", &failure); code != http.StatusBadRequest || failure.Code != ErrCodeNotInteger {
+		t.Fatal("bad increment error", code, failure)
+	}
+}
+
+func TestHTTPList(t *testing.T) {
+	server := makeTestServer(t, "./testdata/httplist.skv", "")
+	defer server.Stop()
+	hs := httptest.NewServer(server.HTTPHandler())
+	defer hs.Close()
+
+	for _, key := range []string{"a", "p1", "p2", "p3", "q"} {
+		server.db.Put([]byte(key), []byte(key))
+	}
+
+	var page struct {
+		Items  []httpItem
+		Cursor string
+	}
+	keys := make([]string, 0)
+	url := hs.URL + "/kv?prefix=p&limit=2"
+	for {
+		page.Cursor = ""
+		if code := doHTTP(t, "GET", url, "", &page); code != http.StatusOK {
+			t.Fatal("list failed", code)
+		}
+		for _, item := range page.Items {
+			keys = append(keys, item.Key)
+		}
+		if page.Cursor == "" {
+			break
+		}
+		url = hs.URL + "/kv?prefix=p&limit=2&cursor=" + page.Cursor
+	}
+	if strings.Join(keys, ",") != "p1,p2,p3" {
+		t.Fatal("bad listing", keys)
+	}
+
+	doHTTP(t, "GET", hs.URL+"/kv?start=b&end=q", "", &page)
+	if len(page.Items) != 3 || page.Cursor != "" {
+		t.Fatal("bad range", page)
+	}
+}
+
+func TestHTTPTransaction(t *testing.T) {
+	server := makeTestServer(t, "./testdata/httptx.skv", "")
+	defer server.Stop()
+	hs := httptest.NewServer(server.HTTPHandler())
+	defer hs.Close()
+
+	var out struct{ Results []httpOpResult }
+	code := doHTTP(t, "POST", hs.URL+"/tx", `{"ops":[
+		{"op":"put","key":"a","value":"1"},
+		{"op":"incr","key":"a","by":2},
+		{"op":"get","key":"a"},
+		{"op":"get","key":"missing"}]}`, &out)
+	if code != http.StatusOK || len(out.Results) != 4 {
+		t.Fatal("tx failed", code, out)
+	}
+	if *out.Results[1].Number != 3 || *out.Results[2].Value != "3" || out.Results[3].Value != nil {
+		t.Fatal("bad results", out)
+	}
+
+	// a failing operation undoes the whole batch
+	code = doHTTP(t, "POST", hs.URL+"/tx", `{"ops":[
+		{"op":"put","key":"a","value":"x"},
+		{"op":"nope","key":"a"}]}`, &struct{}{})
+	if code != http.StatusBadRequest {
+		t.Fatal("bad op accepted", code)
+	}
+	if value, _ := server.db.Get([]byte("a")); string(value) != "3" {
+		t.Fatal("failed batch applied", string(value))
+	}
+
+	code = doHTTP(t, "POST", hs.URL+"/tx", `{"read_only":true,"ops":[{"op":"put","key":"a","value":"x"}]}`, &struct{}{})
+	if code != http.StatusBadRequest {
+		t.Fatal("write accepted in read-only batch", code)
+	}
+}
+
+func TestHTTPAuth(t *testing.T) {
+	server := makeTestServer(t, "./testdata/httpauth.skv", "")
+	server.RequireAuth = true
+	defer server.Stop()
+	server.db.SetUser("alice", "secret", []Grant{{Prefix: "a", Perms: PermRead | PermWrite}})
+	token, _ := server.db.NewToken("alice")
+	server.db.Put([]byte("b"), []byte("1"))
+	hs := httptest.NewServer(server.HTTPHandler())
+	defer hs.Close()
+
+	do := func(method string, path string, body string, auth func(r *http.Request)) int {
+		req, err := http.NewRequest(method, hs.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		auth(req)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	basic := func(password string) func(r *http.Request) {
+		return func(r *http.Request) { r.SetBasicAuth("alice", password) }
+	}
+	bearer := func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }
+
+	if code := do("GET", "/kv/a", "", func(r *http.Request) {}); code != http.StatusUnauthorized {
+		t.Fatal("request served without credentials", code)
+	}
+	if code := do("GET", "/kv/a", "", basic("guess")); code != http.StatusUnauthorized {
+		t.Fatal("wrong password accepted", code)
+	}
+	if code := do("PUT", "/kv/a", `{"value":"1"}`, basic("secret")); code != http.StatusNoContent {
+		t.Fatal("granted write refused", code)
+	}
+	if code := do("GET", "/kv/b", "", bearer); code != http.StatusForbidden {
+		t.Fatal("read without permission", code)
+	}
+	if code := do("POST", "/tx", `{"ops":[{"op":"incr","key":"b"}]}`, bearer); code != http.StatusForbidden {
+		t.Fatal("batch write without permission", code)
+	}
+
+	req, _ := http.NewRequest("GET", hs.URL+"/kv", nil)
+	bearer(req)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var out struct{ Items []httpItem }
+	json.NewDecoder(resp.Body).Decode(&out)
+	if len(out.Items) != 1 || out.Items[0].Key != "a" {
+		t.Fatal("listed keys without permission", out)
+	}
+
+	// the keys of users and tokens come first and must not use up the page
+	req, _ = http.NewRequest("GET", hs.URL+"/kv?limit=1", nil)
+	bearer(req)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var page struct {
+		Items  []httpItem
+		Cursor string
+	}
+	json.NewDecoder(resp.Body).Decode(&page)
+	if len(page.Items) != 1 || page.Items[0].Key != "a" || page.Cursor != "" {
+		t.Fatal("bad page past unreadable keys", page)
+	}
+}
+
+func TestHTTPShutdown(t *testing.T) {
+	server := makeTestServer(t, "./testdata/httpshutdown.skv", "")
+	hs := httptest.NewServer(server.HTTPHandler())
+	defer hs.Close()
+	committing := make(chan struct{})
+	var committed int32
+	server.db.OnPreCommit(func(tx transaction.Transaction, writes []storage.KV) error {
+		close(committing)
+		time.Sleep(200 * time.Millisecond)
+		atomic.StoreInt32(&committed, 1)
+		return nil
+	})
+
+	go func() {
+		req, _ := http.NewRequest("POST", hs.URL+"/tx", strings.NewReader(`{"ops":[{"op":"put","key":"a","value":"1"}]}`))
+		if resp, err := http.DefaultClient.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-committing
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatal("expected the shutdown to time out", err)
+	}
+	// the DB is closed only once the handler is done with it
+	if atomic.LoadInt32(&committed) == 0 {
+		t.Fatal("shutdown returned before the request finished")
+	}
+	if code := doHTTP(t, "GET", hs.URL+"/kv/a", "", nil); code != http.StatusServiceUnavailable {
+		t.Fatal("request served after shutdown", code)
+	}
+}
@@ -1,10 +1,17 @@
 package index
 
+import (
+	"bytes"
+	"container/heap"
+	"sort"
+)
+
 type Index interface {
 	Get(key []byte) (value []byte)
 	Has(key []byte) bool
 	Put(key []byte, value []byte)
 	Delete(key []byte)
+	Keys(start []byte, end []byte, limit int) [][]byte
 }
 
 type NaiveIndex struct {
@@ -34,3 +41,43 @@ func (index *NaiveIndex) Put(key []byte, value []byte) {
 func (index *NaiveIndex) Delete(key []byte) {
 	delete(index.kvs, string(key))
 }
+
+// Keys returns the keys in [start, end) in ascending order, only the first
+// limit of them unless limit is 0. A nil end leaves the range unbounded
+// above. The whole map is walked either way, but past limit only the
+// smallest keys seen so far are kept.
+func (index *NaiveIndex) Keys(start []byte, end []byte, limit int) [][]byte {
+	ret := make(keyHeap, 0)
+	for k := range index.kvs {
+		key := []byte(k)
+		if bytes.Compare(key, start) < 0 || (end != nil && bytes.Compare(key, end) >= 0) {
+			continue
+		}
+		switch {
+		case limit <= 0 || len(ret) < limit:
+			heap.Push(&ret, key)
+		case bytes.Compare(key, ret[0]) < 0:
+			ret[0] = key
+			heap.Fix(&ret, 0)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return bytes.Compare(ret[i], ret[j]) < 0
+	})
+	return ret
+}
+
+// keyHeap keeps the largest key on top, the first to go when a smaller one
+// comes.
+type keyHeap [][]byte
+
+func (h keyHeap) Len() int            { return len(h) }
+func (h keyHeap) Less(i, j int) bool  { return bytes.Compare(h[i], h[j]) > 0 }
+func (h keyHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *keyHeap) Push(x interface{}) { *h = append(*h, x.([]byte)) }
+func (h *keyHeap) Pop() interface{} {
+	old := *h
+	key := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return key
+}
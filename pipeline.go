@@ -0,0 +1,230 @@
+package skv
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/Al0ha0e/skv/transaction"
+)
+
+const DefaultMaxInFlight = 64
+
+// implicitTx is the handle of the transaction opened by OPTXSTART without
+// FlagNewTx, the one requests sent without a handle run in.
+const implicitTx uint32 = 0
+
+// pipeline runs the requests of a connection concurrently, up to MaxInFlight
+// of them: direct requests, and those of the transactions, the implicit one
+// and those opened by handle.
+// Requests on the same key, or in the same transaction, still run in the
+// order they came in, but any reply may go out first, tagged with its
+// request id.
+type pipeline struct {
+	ts      *TesterServer
+	conn    net.Conn
+	ctx     context.Context
+	slots   chan struct{}
+	ends    chan struct{}            // slots of the requests ending a transaction
+	direct  sync.WaitGroup           // direct requests running
+	running sync.WaitGroup           // all requests running
+	last    map[string]chan struct{} // closed once the last request in a chain ran
+	txs     map[uint32]transaction.Transaction
+	nextTx  uint32
+	lock    sync.Mutex // guards last and txs
+	wlock   sync.Mutex // keeps replies from interleaving
+}
+
+func makePipeline(ctx context.Context, ts *TesterServer, conn net.Conn) *pipeline {
+	slots := ts.MaxInFlight
+	if slots < 1 || ts.Protocol == ProtocolLegacy {
+		// replies of the legacy protocol carry no id and must stay in order
+		slots = 1
+	}
+	return &pipeline{
+		ts:    ts,
+		conn:  conn,
+		ctx:   ctx,
+		slots: make(chan struct{}, slots),
+		ends:  make(chan struct{}, slots),
+		last:  make(map[string]chan struct{}),
+		txs:   make(map[uint32]transaction.Transaction),
+	}
+}
+
+func (p *pipeline) send(res OperationResult) error {
+	p.wlock.Lock()
+	defer p.wlock.Unlock()
+	err := p.ts.send(p.conn, res)
+	if err != nil {
+		// the client stopped reading its replies, closing the connection
+		// makes the reader give up as well
+		p.conn.Close()
+	}
+	return err
+}
+
+// run runs fn after the requests queued before on the same chain, in the
+// background unless requests must be answered in order, and sends its reply.
+// Requests ending a transaction take their slots apart from the others: they
+// never wait for a lock, and may be what the requests holding all the other
+// slots wait for.
+func (p *pipeline) run(chain string, wg *sync.WaitGroup, ends bool, fn func() OperationResult) {
+	if cap(p.slots) == 1 {
+		p.send(fn())
+		return
+	}
+
+	p.lock.Lock()
+	prev := p.last[chain]
+	done := make(chan struct{})
+	p.last[chain] = done
+	p.lock.Unlock()
+
+	slots := p.slots
+	if ends {
+		slots = p.ends
+	}
+	slots <- struct{}{}
+	p.running.Add(1)
+	if wg != nil {
+		wg.Add(1)
+	}
+	go func() {
+		defer p.running.Done()
+		if wg != nil {
+			defer wg.Done()
+		}
+		if prev != nil {
+			<-prev
+		}
+		res := fn()
+
+		p.lock.Lock()
+		if p.last[chain] == done {
+			delete(p.last, chain)
+		}
+		p.lock.Unlock()
+		close(done)
+
+		p.send(res)
+		<-slots
+	}()
+}
+
+// txChain is the chain the requests of the transaction of handle tx run on.
+func txChain(tx uint32) string {
+	return "t" + strconv.FormatUint(uint64(tx), 10)
+}
+
+// processDirect runs pack outside of any transaction, as user.
+func (p *pipeline) processDirect(pack Operation, user *User) {
+	p.run("k"+pack.Key, &p.direct, false, func() OperationResult {
+		return p.ts.processDirect(pack, user)
+	})
+}
+
+// begin opens a transaction behind a new handle.
+func (p *pipeline) begin(pack Operation) OperationResult {
+	// the transaction sees the direct writes sent before it
+	p.direct.Wait()
+	tx, err := p.ts.db.StartTransaction(txOptions(pack))
+	res := result(pack.ID, nil, err)
+	if err != nil {
+		return res
+	}
+
+	p.lock.Lock()
+	p.nextTx++
+	for p.nextTx == implicitTx || p.txs[p.nextTx] != nil {
+		p.nextTx++
+	}
+	p.txs[p.nextTx] = tx
+	res.Tx = p.nextTx
+	p.lock.Unlock()
+	return res
+}
+
+// start opens the implicit transaction, which the requests without a handle
+// run in, once the requests sent in the previous one ran. That one is
+// aborted if it is still open.
+func (p *pipeline) start(pack Operation) {
+	// the transaction sees the direct writes sent before it
+	p.direct.Wait()
+	p.run(txChain(implicitTx), nil, false, func() OperationResult {
+		p.lock.Lock()
+		prev := p.txs[implicitTx]
+		delete(p.txs, implicitTx)
+		p.lock.Unlock()
+		if prev != nil {
+			prev.Abort()
+		}
+
+		tx, err := p.ts.db.StartTransaction(txOptions(pack))
+		if err == nil {
+			p.lock.Lock()
+			p.txs[implicitTx] = tx
+			p.lock.Unlock()
+		}
+		return result(pack.ID, nil, err)
+	})
+}
+
+// inTx tells whether a request without a handle belongs to the implicit
+// transaction: it is open, or requests queued for it still have to run.
+func (p *pipeline) inTx() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	_, open := p.txs[implicitTx]
+	_, queued := p.last[txChain(implicitTx)]
+	return open || queued
+}
+
+// processTx runs pack in the transaction of handle pack.Tx, as user. As with
+// the implicit transaction, an operation failing on an error that ended the
+// transaction releases the handle. Once the implicit transaction ended, the
+// requests queued for it run as direct ones.
+func (p *pipeline) processTx(pack Operation, user *User) {
+	ends := pack.OP == OPCOMMIT || pack.OP == OPABORT
+	p.run(txChain(pack.Tx), nil, ends, func() OperationResult {
+		p.lock.Lock()
+		tx, has := p.txs[pack.Tx]
+		p.lock.Unlock()
+		if !has {
+			if pack.Tx == implicitTx {
+				return p.ts.processDirect(pack, user)
+			}
+			res := result(pack.ID, nil, transaction.ErrNotRunning)
+			res.Tx = pack.Tx
+			return res
+		}
+
+		res := p.ts.processTx(p.ctx, pack, tx, user)
+		res.Tx = pack.Tx
+		if ends || (res.State&2 == 0 && ended(res.Err())) {
+			if res.State&2 == 0 {
+				// make sure the transaction ended in the database as well
+				tx.Abort()
+			}
+			p.lock.Lock()
+			delete(p.txs, pack.Tx)
+			p.lock.Unlock()
+		}
+		return res
+	})
+}
+
+// wait returns once every request started so far has been answered.
+func (p *pipeline) wait() {
+	p.running.Wait()
+}
+
+// close aborts the transactions left open, once no request runs anymore.
+func (p *pipeline) close() {
+	p.wait()
+	for _, tx := range p.txs {
+		tx.Abort()
+	}
+	p.txs = nil
+}
@@ -0,0 +1,332 @@
+package skv
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"io"
+
+	"github.com/Al0ha0e/skv/storage"
+	"github.com/Al0ha0e/skv/transaction"
+)
+
+// Protocol selects the framing spoken on a connection.
+type Protocol = int
+
+const (
+	// ProtocolBinary is the versioned, length-prefixed framing carrying
+	// arbitrary keys and values.
+	ProtocolBinary Protocol = iota
+	// ProtocolLegacy is the original framing: gob encoded operations and
+	// fixed-size replies, with int32 values only.
+	ProtocolLegacy
+)
+
+// ProtocolVersion 2 added transaction handles.
+const ProtocolVersion uint8 = 2
+
+// FlagNewTx asks OPTXSTART for a transaction handle, returned in the Tx of
+// the reply, instead of starting the implicit transaction of the connection.
+// Operations carrying the handle in their Tx run in that transaction.
+const FlagNewTx uint8 = 1
+
+// MaxFrameSize bounds the key and value of a single frame.
+const MaxFrameSize = 64 << 20
+
+var (
+	ErrProtocolVersion = errors.New("unsupported protocol version")
+	ErrFrameTooLarge   = errors.New("frame too large")
+	ErrUnknownOP       = errors.New("unknown operation")
+	ErrBadValue        = errors.New("malformed value")
+)
+
+// ErrorCode tells clients why an operation failed. Codes are part of the
+// protocol and must never be renumbered.
+type ErrorCode = uint16
+
+const (
+	ErrCodeNone ErrorCode = iota
+	ErrCodeUnknown
+	ErrCodeUnknownOP
+	ErrCodeBadValue
+	ErrCodeNotRunning
+	ErrCodeLockConflict
+	ErrCodeDeadlock
+	ErrCodeDie
+	ErrCodeWounded
+	ErrCodeLockTimeout
+	ErrCodeTxTimeout
+	ErrCodeSerialization
+	ErrCodeBadIsolation
+	ErrCodeReadOnlyTx
+	ErrCodeNoSavepoint
+	ErrCodeTSExhausted
+	ErrCodeFutureTS
+	ErrCodeBeyondRetention
+	ErrCodeCRCMismatch
+	ErrCodeTruncated
+	ErrCodeCanceled
+	ErrCodeDeadlineExceeded
+	ErrCodeNotInteger
+	ErrCodeOverflow
+	ErrCodeOverloaded
+	ErrCodeAuthFailed
+	ErrCodeUnauthenticated
+	ErrCodePermission
+)
+
+var codeErrors = []error{
+	ErrCodeUnknownOP:        ErrUnknownOP,
+	ErrCodeBadValue:         ErrBadValue,
+	ErrCodeNotRunning:       transaction.ErrNotRunning,
+	ErrCodeLockConflict:     transaction.ErrLockConflict,
+	ErrCodeDeadlock:         transaction.ErrDeadlock,
+	ErrCodeDie:              transaction.ErrDie,
+	ErrCodeWounded:          transaction.ErrWounded,
+	ErrCodeLockTimeout:      transaction.ErrLockTimeout,
+	ErrCodeTxTimeout:        transaction.ErrTxTimeout,
+	ErrCodeSerialization:    transaction.ErrSerialization,
+	ErrCodeBadIsolation:     transaction.ErrBadIsolation,
+	ErrCodeReadOnlyTx:       transaction.ErrReadOnlyTx,
+	ErrCodeNoSavepoint:      transaction.ErrNoSavepoint,
+	ErrCodeTSExhausted:      transaction.ErrTSExhausted,
+	ErrCodeFutureTS:         transaction.ErrFutureTS,
+	ErrCodeBeyondRetention:  storage.ErrBeyondRetention,
+	ErrCodeCRCMismatch:      storage.ErrCRCMismatch,
+	ErrCodeTruncated:        storage.ErrTruncated,
+	ErrCodeCanceled:         context.Canceled,
+	ErrCodeDeadlineExceeded: context.DeadlineExceeded,
+	ErrCodeNotInteger:       ErrNotInteger,
+	ErrCodeOverflow:         ErrOverflow,
+	ErrCodeOverloaded:       ErrOverloaded,
+	ErrCodeAuthFailed:       ErrAuthFailed,
+	ErrCodeUnauthenticated:  ErrUnauthenticated,
+	ErrCodePermission:       ErrPermission,
+}
+
+// errorCode maps err, possibly wrapped, to the code sent for it.
+func errorCode(err error) ErrorCode {
+	if err == nil {
+		return ErrCodeNone
+	}
+	for code, target := range codeErrors {
+		if target != nil && errors.Is(err, target) {
+			return ErrorCode(code)
+		}
+	}
+	return ErrCodeUnknown
+}
+
+// Err returns the error res failed with, the sentinel matching its code when
+// there is one, so it can be tested with errors.Is.
+func (res OperationResult) Err() error {
+	if res.State&2 != 0 {
+		return nil
+	}
+	if int(res.Code) < len(codeErrors) && codeErrors[res.Code] != nil {
+		return codeErrors[res.Code]
+	}
+	if res.Message != "" {
+		return errors.New(res.Message)
+	}
+	return errors.New("operation failed")
+}
+
+type requestHeader struct {
+	Version  uint8
+	ID       uint32
+	Tx       uint32
+	OP       OPType
+	Flags    uint8
+	KeySize  uint32
+	DataSize uint32
+}
+
+type responseHeader struct {
+	Version     uint8
+	ID          uint32
+	Tx          uint32
+	State       int8
+	Flags       uint8
+	Code        ErrorCode
+	DataSize    uint32
+	MessageSize uint32
+}
+
+type legacyResult struct {
+	Value int32
+	State int8
+}
+
+func encodeInt32(v int32) []byte {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.BigEndian, v)
+	return buf.Bytes()
+}
+
+// decodeInt32 reads an int32 from the head of data, 0 if it is too short.
+func decodeInt32(data []byte) int32 {
+	v := int32(0)
+	binary.Read(bytes.NewBuffer(data), binary.BigEndian, &v)
+	return v
+}
+
+// data returns the value bytes of op, the int32 Value when no Data is set.
+func (op Operation) data() []byte {
+	if op.Data != nil {
+		return op.Data
+	}
+	return encodeInt32(op.Value)
+}
+
+func readBytes(r io.Reader, size uint32) ([]byte, error) {
+	if size > MaxFrameSize {
+		return nil, ErrFrameTooLarge
+	}
+	buf := make([]byte, size)
+	_, err := io.ReadFull(r, buf)
+	return buf, err
+}
+
+func writeRequest(w io.Writer, proto Protocol, op Operation) error {
+	if proto == ProtocolLegacy {
+		buf := &bytes.Buffer{}
+		gob.NewEncoder(buf).Encode(op)
+		_, err := w.Write(buf.Bytes())
+		return err
+	}
+
+	data := op.data()
+	if len(op.Key) > MaxFrameSize || len(data) > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+	header := requestHeader{
+		Version:  ProtocolVersion,
+		ID:       op.ID,
+		Tx:       op.Tx,
+		OP:       op.OP,
+		Flags:    op.Flags,
+		KeySize:  uint32(len(op.Key)),
+		DataSize: uint32(len(data)),
+	}
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.BigEndian, &header)
+	buf.WriteString(op.Key)
+	buf.Write(data)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// readRequest reads the next operation. Whatever the framing, both Data and
+// Value are filled in: Value holds the int32 carried in a 4-byte Data.
+func readRequest(r io.Reader, proto Protocol) (op Operation, err error) {
+	if proto == ProtocolLegacy {
+		err = gob.NewDecoder(r).Decode(&op)
+		if op.Data == nil {
+			op.Data = encodeInt32(op.Value)
+		}
+		return op, err
+	}
+
+	var header requestHeader
+	if err = binary.Read(r, binary.BigEndian, &header); err != nil {
+		return op, err
+	}
+	if header.Version != ProtocolVersion {
+		return op, ErrProtocolVersion
+	}
+	key, err := readBytes(r, header.KeySize)
+	if err != nil {
+		return op, err
+	}
+	data, err := readBytes(r, header.DataSize)
+	if err != nil {
+		return op, err
+	}
+
+	op = Operation{
+		ID:    header.ID,
+		Tx:    header.Tx,
+		OP:    header.OP,
+		Flags: header.Flags,
+		Key:   string(key),
+		Data:  data,
+	}
+	if len(data) == 4 {
+		op.Value = decodeInt32(data)
+	}
+	return op, nil
+}
+
+func writeResponse(w io.Writer, proto Protocol, res OperationResult) error {
+	buf := &bytes.Buffer{}
+	if proto == ProtocolLegacy {
+		binary.Write(buf, binary.BigEndian, legacyResult{
+			Value: decodeInt32(res.Data),
+			State: res.State,
+		})
+	} else {
+		header := responseHeader{
+			Version:     ProtocolVersion,
+			ID:          res.ID,
+			Tx:          res.Tx,
+			State:       res.State,
+			Flags:       res.Flags,
+			Code:        res.Code,
+			DataSize:    uint32(len(res.Data)),
+			MessageSize: uint32(len(res.Message)),
+		}
+		binary.Write(buf, binary.BigEndian, &header)
+		buf.Write(res.Data)
+		buf.WriteString(res.Message)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func readResponse(r io.Reader, proto Protocol) (res OperationResult, err error) {
+	if proto == ProtocolLegacy {
+		var legacy legacyResult
+		err = binary.Read(r, binary.BigEndian, &legacy)
+		res.Value = legacy.Value
+		res.State = legacy.State
+		if res.State&1 != 0 {
+			res.Data = encodeInt32(legacy.Value)
+		}
+		return res, err
+	}
+
+	var header responseHeader
+	if err = binary.Read(r, binary.BigEndian, &header); err != nil {
+		return res, err
+	}
+	if header.Version != ProtocolVersion {
+		return res, ErrProtocolVersion
+	}
+	data, err := readBytes(r, header.DataSize)
+	if err != nil {
+		return res, err
+	}
+	message, err := readBytes(r, header.MessageSize)
+	if err != nil {
+		return res, err
+	}
+
+	res = OperationResult{
+		ID:      header.ID,
+		Tx:      header.Tx,
+		State:   header.State,
+		Flags:   header.Flags,
+		Code:    header.Code,
+		Message: string(message),
+	}
+	if res.State&1 != 0 {
+		res.Data = data
+	}
+	if len(data) == 4 {
+		res.Value = decodeInt32(data)
+	}
+	return res, nil
+}
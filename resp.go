@@ -0,0 +1,873 @@
+package skv
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Al0ha0e/skv/transaction"
+)
+
+// Replies are built from these types and encoded by writeReply: int64 is an
+// integer, []byte a bulk string, nil a null and []interface{} an array.
+type respStatus string
+type respError string
+type respMap []interface{} // keys and values, interleaved
+type respNullArray struct{}
+
+func (e respError) Error() string {
+	return string(e)
+}
+
+var (
+	errRespSyntax     = respError("ERR syntax error")
+	errRespNotInteger = respError("ERR value is not an integer or out of range")
+	errRespProtocol   = errors.New("RESP protocol error")
+	errWatchedChanged = errors.New("watched key changed")
+)
+
+// respMaxBulk bounds a single bulk string, as proto-max-bulk-len does, and
+// respMaxInline a line, which is an inline command or the header of a value.
+const (
+	respMaxBulk   = 512 << 20
+	respMaxInline = 64 << 10
+)
+
+// respMaxItems bounds the items of an aggregate, as Redis bounds the
+// arguments of a command, and respMaxDepth how deep aggregates nest.
+const (
+	respMaxItems = 1024 * 1024
+	respMaxDepth = 16
+)
+
+type respReader struct {
+	r *bufio.Reader
+}
+
+func (rr *respReader) line() (string, error) {
+	var line []byte
+	for {
+		chunk, err := rr.r.ReadSlice('\n')
+		if len(line)+len(chunk) > respMaxInline {
+			return "", errRespProtocol
+		}
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(line), "\r\n"), nil
+	}
+}
+
+// command reads the next command, either an array of bulk strings or an
+// inline command separated by spaces as typed into a terminal.
+func (rr *respReader) command() ([][]byte, error) {
+	for {
+		b, err := rr.r.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if b[0] != '*' {
+			line, err := rr.line()
+			if err != nil {
+				return nil, err
+			}
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+			args := make([][]byte, 0, len(fields))
+			for _, f := range fields {
+				args = append(args, []byte(f))
+			}
+			return args, nil
+		}
+
+		v, err := rr.value()
+		if err != nil {
+			return nil, err
+		}
+		items, ok := v.([]interface{})
+		if !ok {
+			return nil, errRespProtocol
+		}
+		if len(items) == 0 {
+			continue
+		}
+		args := make([][]byte, 0, len(items))
+		for _, item := range items {
+			arg, ok := item.([]byte)
+			if !ok {
+				return nil, errRespProtocol
+			}
+			args = append(args, arg)
+		}
+		return args, nil
+	}
+}
+
+// value reads any RESP2 or RESP3 value. Maps and sets are returned as
+// arrays.
+func (rr *respReader) value() (interface{}, error) {
+	return rr.nested(0)
+}
+
+// nested reads a value found depth aggregates deep.
+func (rr *respReader) nested(depth int) (interface{}, error) {
+	line, err := rr.line()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errRespProtocol
+	}
+
+	switch line[0] {
+	case '+':
+		return respStatus(line[1:]), nil
+	case '-':
+		return respError(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '_':
+		return nil, nil
+	case '#':
+		return line[1:] == "t", nil
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n > respMaxBulk {
+			return nil, errRespProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err = io.ReadFull(rr.r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*', '%', '~':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n > respMaxItems || depth >= respMaxDepth {
+			return nil, errRespProtocol
+		}
+		if n < 0 {
+			return respNullArray{}, nil
+		}
+		if line[0] == '%' {
+			n *= 2
+		}
+		// the count comes from the client, let the items prove it
+		items := make([]interface{}, 0)
+		for i := 0; i < n; i++ {
+			item, err := rr.nested(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	}
+	return nil, errRespProtocol
+}
+
+// writeReply encodes v in RESP2, or in RESP3 when proto is 3.
+func writeReply(w *bufio.Writer, proto int, v interface{}) {
+	switch v := v.(type) {
+	case nil:
+		if proto == 3 {
+			w.WriteString("_\r\n")
+		} else {
+			w.WriteString("$-1\r\n")
+		}
+	case respNullArray:
+		if proto == 3 {
+			w.WriteString("_\r\n")
+		} else {
+			w.WriteString("*-1\r\n")
+		}
+	case respStatus:
+		fmt.Fprintf(w, "+%s\r\n", string(v))
+	case respError:
+		fmt.Fprintf(w, "-%s\r\n", string(v))
+	case int64:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case int:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case string:
+		writeReply(w, proto, []byte(v))
+	case []byte:
+		fmt.Fprintf(w, "$%d\r\n", len(v))
+		w.Write(v)
+		w.WriteString("\r\n")
+	case []interface{}:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, item := range v {
+			writeReply(w, proto, item)
+		}
+	case respMap:
+		if proto == 3 {
+			fmt.Fprintf(w, "%%%d\r\n", len(v)/2)
+		} else {
+			fmt.Fprintf(w, "*%d\r\n", len(v))
+		}
+		for _, item := range v {
+			writeReply(w, proto, item)
+		}
+	default:
+		writeReply(w, proto, respError(fmt.Sprintf("ERR unexpected reply %T", v)))
+	}
+}
+
+type respKind int
+
+const (
+	respConnection respKind = iota // needs no transaction
+	respRead
+	respWrite
+)
+
+type respCommand struct {
+	arity int // counting the name, -n for at least n
+	kind  respKind
+	run   func(c *respConn, tx transaction.Transaction, args [][]byte) (interface{}, error)
+}
+
+// respCommands holds the commands that may be queued by MULTI. MULTI, EXEC,
+// DISCARD, WATCH and UNWATCH act on the connection and are handled apart.
+var respCommands map[string]respCommand
+
+func init() {
+	respCommands = map[string]respCommand{
+		"PING":    {-1, respConnection, respPing},
+		"ECHO":    {2, respConnection, respEcho},
+		"HELLO":   {-1, respConnection, respHello},
+		"SELECT":  {2, respConnection, respSelect},
+		"COMMAND": {-1, respConnection, respCommandInfo},
+		"CLIENT":  {-2, respConnection, respClient},
+		"GET":     {2, respRead, respGet},
+		"EXISTS":  {-2, respRead, respExists},
+		"SCAN":    {-2, respRead, respScan},
+		"SET":     {3, respWrite, respSet},
+		"DEL":     {-2, respWrite, respDel},
+		"INCR":    {2, respWrite, respIncr},
+		"DECR":    {2, respWrite, respIncr},
+		"INCRBY":  {3, respWrite, respIncr},
+		"DECRBY":  {3, respWrite, respIncr},
+	}
+}
+
+func respPing(c *respConn, tx transaction.Transaction, args [][]byte) (interface{}, error) {
+	if len(args) > 2 {
+		return nil, respError("ERR wrong number of arguments for 'ping' command")
+	}
+	if len(args) == 2 {
+		return args[1], nil
+	}
+	return respStatus("PONG"), nil
+}
+
+func respEcho(c *respConn, tx transaction.Transaction, args [][]byte) (interface{}, error) {
+	return args[1], nil
+}
+
+// respHello switches the protocol version, replying with the server
+// properties. AUTH authenticates as AUTH does, which lets a client that has
+// not yet authenticated do both at once; SETNAME is accepted and ignored.
+func respHello(c *respConn, tx transaction.Transaction, args [][]byte) (interface{}, error) {
+	proto := c.proto
+	if len(args) > 1 {
+		var err error
+		proto, err = strconv.Atoi(string(args[1]))
+		if err != nil {
+			return nil, respError("ERR Protocol version is not an integer or out of range")
+		}
+		if proto != 2 && proto != 3 {
+			return nil, respError("NOPROTO unsupported protocol version")
+		}
+	}
+
+	var auth [][]byte
+	for i := 2; i < len(args); i++ {
+		option := strings.ToUpper(string(args[i]))
+		switch {
+		case option == "AUTH" && i+2 < len(args):
+			auth = [][]byte{args[i], args[i+1], args[i+2]}
+			i += 2
+		case option == "SETNAME" && i+1 < len(args):
+			i++
+		default:
+			return nil, respError(fmt.Sprintf("ERR Syntax error in HELLO option '%s'", args[i]))
+		}
+	}
+	if auth != nil {
+		if reply, failed := c.auth(auth).(respError); failed {
+			return nil, reply
+		}
+	}
+	if c.ts.RequireAuth && c.user == nil {
+		return nil, respError("NOAUTH HELLO must be called with the client already authenticated, " +
+			"otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client " +
+			"and select the RESP protocol version at the same time")
+	}
+
+	c.proto = proto
+	return respMap{
+		"server", "skv",
+		"version", "1.0.0",
+		"proto", int64(c.proto),
+		"mode", "standalone",
+		"role", "master",
+		"modules", []interface{}{},
+	}, nil
+}
+
+func respSelect(c *respConn, tx transaction.Transaction, args [][]byte) (interface{}, error) {
+	if string(args[1]) != "0" {
+		return nil, respError("ERR DB index is out of range")
+	}
+	return respStatus("OK"), nil
+}
+
+// respCommandInfo answers the introspection redis-cli does on connecting
+// with nothing, which clients take as no command documentation.
+func respCommandInfo(c *respConn, tx transaction.Transaction, args [][]byte) (interface{}, error) {
+	return []interface{}{}, nil
+}
+
+func respClient(c *respConn, tx transaction.Transaction, args [][]byte) (interface{}, error) {
+	return respStatus("OK"), nil
+}
+
+func respGet(c *respConn, tx transaction.Transaction, args [][]byte) (interface{}, error) {
+	value, err := tx.Get(c.ctx, args[1])
+	if err != nil || value == nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func respExists(c *respConn, tx transaction.Transaction, args [][]byte) (interface{}, error) {
+	n := int64(0)
+	for _, key := range args[1:] {
+		value, err := tx.Get(c.ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if value != nil {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// respScan walks the keys in order. The cursor is the number of keys
+// visited so far, so keys inserted or deleted before it while scanning may
+// shift the walk by as many keys.
+// The SCAN cursor is the last key returned, so that iteration carries on
+// after it however the keys change in between. It is written as a decimal
+// number, as clients expect, of the key behind a 1 byte that keeps leading
+// zero bytes. Cursor 0 starts and ends the iteration.
+func encodeRespCursor(key []byte) string {
+	return new(big.Int).SetBytes(append([]byte{1}, key...)).String()
+}
+
+func decodeRespCursor(cursor string) (key []byte, ok bool) {
+	n, ok := new(big.Int).SetString(cursor, 10)
+	if !ok || n.Sign() < 0 {
+		return nil, false
+	}
+	if n.Sign() == 0 {
+		return nil, true
+	}
+	b := n.Bytes()
+	if b[0] != 1 {
+		return nil, false
+	}
+	return b[1:], true
+}
+
+func respScan(c *respConn, tx transaction.Transaction, args [][]byte) (interface{}, error) {
+	last, ok := decodeRespCursor(string(args[1]))
+	if !ok {
+		return nil, respError("ERR invalid cursor")
+	}
+	count := 10
+	var err error
+	var pattern []byte
+	for i := 2; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return nil, errRespSyntax
+		}
+		switch strings.ToUpper(string(args[i])) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			count, err = strconv.Atoi(string(args[i+1]))
+			if err != nil || count <= 0 {
+				return nil, errRespSyntax
+			}
+		case "TYPE":
+			if string(args[i+1]) != "string" {
+				return []interface{}{"0", []interface{}{}}, nil
+			}
+		default:
+			return nil, errRespSyntax
+		}
+	}
+
+	start := []byte{}
+	if last != nil {
+		start = append(last, 0)
+	}
+	// one more pair tells whether there is a next page
+	kvs, err := tx.ScanLimit(c.ctx, start, nil, count+1)
+	if err != nil {
+		return nil, err
+	}
+	next := "0"
+	if len(kvs) > count {
+		kvs = kvs[:count]
+		next = encodeRespCursor(kvs[count-1].Key)
+	}
+	keys := make([]interface{}, 0)
+	for _, kv := range kvs {
+		if pattern == nil || globMatch(pattern, kv.Key) {
+			keys = append(keys, kv.Key)
+		}
+	}
+	return []interface{}{next, keys}, nil
+}
+
+// respSet stores the value as given, without expiry or conditions.
+func respSet(c *respConn, tx transaction.Transaction, args [][]byte) (interface{}, error) {
+	if err := tx.Put(c.ctx, args[1], args[2]); err != nil {
+		return nil, err
+	}
+	return respStatus("OK"), nil
+}
+
+func respDel(c *respConn, tx transaction.Transaction, args [][]byte) (interface{}, error) {
+	n := int64(0)
+	for _, key := range args[1:] {
+		value, err := tx.GetForUpdate(c.ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if value == nil {
+			continue
+		}
+		if err = tx.Delete(c.ctx, key); err != nil {
+			return nil, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// respIncr implements INCR, DECR, INCRBY and DECRBY. Like Redis, it works on
+// values holding a decimal integer, not on the 4-byte integers of OPINC.
+func respIncr(c *respConn, tx transaction.Transaction, args [][]byte) (interface{}, error) {
+	name := strings.ToUpper(string(args[0]))
+	inc := int64(1)
+	if len(args) == 3 {
+		var err error
+		inc, err = strconv.ParseInt(string(args[2]), 10, 64)
+		if err != nil {
+			return nil, errRespNotInteger
+		}
+	}
+	if strings.HasPrefix(name, "DECR") {
+		inc = -inc
+	}
+
+	n, err := increaseDecimal(c.ctx, tx, args[1], inc)
+	if err == ErrNotInteger {
+		return nil, errRespNotInteger
+	}
+	if err == ErrOverflow {
+		return nil, respError("ERR " + err.Error())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// globMatch matches s against a Redis glob pattern: * and ? wildcards,
+// [...] classes with ranges and ^ negation, and \ escapes.
+func globMatch(pattern []byte, s []byte) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if globMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			i := 1
+			negate := i < len(pattern) && pattern[i] == '^'
+			if negate {
+				i++
+			}
+			matched := false
+			for ; i < len(pattern) && pattern[i] != ']'; i++ {
+				if pattern[i] == '\\' && i+1 < len(pattern) {
+					i++
+					matched = matched || pattern[i] == s[0]
+				} else if i+2 < len(pattern) && pattern[i+1] == '-' && pattern[i+2] != ']' {
+					lo, hi := pattern[i], pattern[i+2]
+					if lo > hi {
+						lo, hi = hi, lo
+					}
+					matched = matched || (s[0] >= lo && s[0] <= hi)
+					i += 2
+				} else {
+					matched = matched || pattern[i] == s[0]
+				}
+			}
+			if matched == negate {
+				return false
+			}
+			if i < len(pattern) {
+				pattern = pattern[i:]
+			} else {
+				pattern = pattern[i-1:]
+			}
+		default:
+			if pattern[0] == '\\' && len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			if len(s) == 0 || pattern[0] != s[0] {
+				return false
+			}
+		}
+		pattern = pattern[1:]
+		s = s[1:]
+	}
+	return len(s) == 0
+}
+
+// respConn is the state of a RESP connection: the protocol version chosen
+// by HELLO and the commands queued since MULTI.
+type respConn struct {
+	ts      *TesterServer
+	ctx     context.Context
+	proto   int
+	multi   bool
+	queued  [][][]byte
+	broken  bool              // a command failed to queue, EXEC must fail
+	watched map[string][]byte // value of every watched key when it was watched
+	user    *User             // set by AUTH, nil for anyone until then
+}
+
+// respErrorOf turns an error returned by the database into a reply.
+func respErrorOf(err error) respError {
+	if e, ok := err.(respError); ok {
+		return e
+	}
+	if err == ErrPermission {
+		return respError("NOPERM " + err.Error())
+	}
+	return respError("ERR " + err.Error())
+}
+
+// dispatch runs one command, returning its reply.
+func (c *respConn) dispatch(args [][]byte) interface{} {
+	name := strings.ToUpper(string(args[0]))
+	if name == "AUTH" {
+		return c.auth(args)
+	}
+	// HELLO may authenticate, and tells by itself when it cannot go on
+	if c.ts.RequireAuth && c.user == nil && name != "HELLO" {
+		return respError("NOAUTH Authentication required.")
+	}
+	switch name {
+	case "MULTI":
+		if c.multi {
+			return respError("ERR MULTI calls can not be nested")
+		}
+		c.multi = true
+		return respStatus("OK")
+	case "EXEC":
+		if !c.multi {
+			return respError("ERR EXEC without MULTI")
+		}
+		return c.exec()
+	case "DISCARD":
+		if !c.multi {
+			return respError("ERR DISCARD without MULTI")
+		}
+		c.reset()
+		return respStatus("OK")
+	case "WATCH":
+		if c.multi {
+			return respError("ERR WATCH inside MULTI is not allowed")
+		}
+		if len(args) < 2 {
+			return respError("ERR wrong number of arguments for 'watch' command")
+		}
+		return c.watch(args[1:])
+	case "UNWATCH":
+		c.watched = nil
+		return respStatus("OK")
+	}
+
+	cmd, has := respCommands[name]
+	var reply interface{}
+	if !has {
+		reply = respError(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+	} else if (cmd.arity > 0 && len(args) != cmd.arity) || len(args) < -cmd.arity {
+		reply = respError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+	}
+	if c.multi {
+		if reply != nil {
+			c.broken = true
+			return reply
+		}
+		c.queued = append(c.queued, args)
+		return respStatus("QUEUED")
+	}
+	if reply != nil {
+		return reply
+	}
+
+	run := func(tx transaction.Transaction) (err error) {
+		reply, err = cmd.run(c, guard(tx, c.user), args)
+		return err
+	}
+	var err error
+	switch cmd.kind {
+	case respConnection:
+		err = run(nil)
+	case respRead:
+		err = c.ts.db.View(run)
+	case respWrite:
+		err = c.ts.db.Update(run)
+	}
+	if err != nil {
+		return respErrorOf(err)
+	}
+	return reply
+}
+
+// auth implements AUTH token and AUTH user password.
+func (c *respConn) auth(args [][]byte) interface{} {
+	var user *User
+	var err error
+	switch len(args) {
+	case 2:
+		user, err = c.ts.db.AuthenticateToken(string(args[1]))
+	case 3:
+		user, err = c.ts.db.Authenticate(string(args[1]), string(args[2]))
+	default:
+		return respError("ERR wrong number of arguments for 'auth' command")
+	}
+	if err == ErrAuthFailed {
+		return respError("WRONGPASS invalid username-password pair or user is disabled.")
+	}
+	if err != nil {
+		return respErrorOf(err)
+	}
+	c.user = user
+	return respStatus("OK")
+}
+
+func (c *respConn) watch(keys [][]byte) interface{} {
+	if c.watched == nil {
+		c.watched = make(map[string][]byte)
+	}
+	for _, key := range keys {
+		if _, has := c.watched[string(key)]; has {
+			continue
+		}
+		if err := authorize(c.user, key, PermRead); err != nil {
+			return respErrorOf(err)
+		}
+		value, err := c.ts.db.Get(key)
+		if err != nil {
+			return respErrorOf(err)
+		}
+		c.watched[string(key)] = value
+	}
+	return respStatus("OK")
+}
+
+// exec runs the queued commands in one serializable transaction. Watched
+// keys are locked and compared with the values they had when watched, so a
+// key changed in between and back again goes unnoticed. Errors of single
+// commands are replied in place, as Redis does, while an error of the
+// transaction itself fails the whole EXEC.
+func (c *respConn) exec() interface{} {
+	defer c.reset()
+	if c.broken {
+		return respError("EXECABORT Transaction discarded because of previous errors.")
+	}
+
+	var replies []interface{}
+	err := c.ts.db.Update(func(tx transaction.Transaction) error {
+		for key, watched := range c.watched {
+			value, err := tx.GetForUpdate(c.ctx, []byte(key))
+			if err != nil {
+				return err
+			}
+			if (value == nil) != (watched == nil) || string(value) != string(watched) {
+				return errWatchedChanged
+			}
+		}
+
+		replies = make([]interface{}, 0, len(c.queued))
+		for _, args := range c.queued {
+			cmd := respCommands[strings.ToUpper(string(args[0]))]
+			reply, err := cmd.run(c, guard(tx, c.user), args)
+			if e, ok := err.(respError); ok {
+				reply = e
+			} else if err == ErrPermission {
+				reply = respErrorOf(err)
+			} else if err != nil {
+				return err
+			}
+			replies = append(replies, reply)
+		}
+		return nil
+	})
+	if err == errWatchedChanged {
+		return respNullArray{}
+	}
+	if err != nil {
+		return respErrorOf(err)
+	}
+	return replies
+}
+
+func (c *respConn) reset() {
+	c.multi = false
+	c.queued = nil
+	c.broken = false
+	c.watched = nil
+}
+
+// respRequest is a command read off a RESP connection, or the protocol
+// error met instead.
+type respRequest struct {
+	args [][]byte
+	err  error
+	more bool // further commands are buffered already, replies can wait
+}
+
+// readRESP reads the commands of conn into cmds until the client goes away
+// or done is closed.
+func (ts *TesterServer) readRESP(conn net.Conn, reader *respReader, cmds chan<- respRequest, done <-chan struct{}) {
+	defer close(cmds)
+	for ts.await(conn) {
+		// the idle timeout runs until a command starts coming
+		if _, err := reader.r.Peek(1); err != nil {
+			ts.hangUp(conn, done)
+			return
+		}
+		ts.reading(conn)
+		args, err := reader.command()
+		if err != nil && err != errRespProtocol {
+			ts.hangUp(conn, done)
+			return
+		}
+		select {
+		case cmds <- respRequest{args: args, err: err, more: reader.r.Buffered() > 0}:
+		case <-done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (ts *TesterServer) processRESP(ctx context.Context, conn net.Conn) {
+	c := &respConn{
+		ts:    ts,
+		ctx:   ctx,
+		proto: 2,
+	}
+	reader := &respReader{r: bufio.NewReader(conn)}
+	writer := bufio.NewWriter(conn)
+
+	cmds := make(chan respRequest)
+	done := make(chan struct{})
+	read := make(chan struct{})
+	go func() {
+		ts.readRESP(conn, reader, cmds, done)
+		close(read)
+	}()
+	defer func() {
+		close(done)
+		// wake up the reader, it may still wait for a command
+		conn.SetReadDeadline(time.Now())
+		<-read
+		ts.untrack(conn)
+	}()
+
+	for cmd := range cmds {
+		if cmd.err == errRespProtocol {
+			writeReply(writer, c.proto, respError("ERR Protocol error"))
+			ts.writing(conn)
+			writer.Flush()
+			break
+		}
+
+		if strings.ToUpper(string(cmd.args[0])) == "QUIT" {
+			writeReply(writer, c.proto, respStatus("OK"))
+			ts.writing(conn)
+			writer.Flush()
+			break
+		}
+		writeReply(writer, c.proto, c.dispatch(cmd.args))
+		// replies to pipelined commands go out together
+		if !cmd.more {
+			ts.writing(conn)
+			if err := writer.Flush(); err != nil {
+				break
+			}
+		}
+	}
+}
+
+// RunRESP serves the database on url to Redis clients, speaking RESP2 or,
+// after HELLO 3, RESP3. It can run alongside Run.
+func (ts *TesterServer) RunRESP(url string) error {
+	if err := ts.listen(url, &ts.respListener); err != nil {
+		return err
+	}
+	return ts.serve(ts.respListener, ts.processRESP, ts.rejectRESP)
+}
+
+// rejectRESP answers a client over MaxConns as Redis does.
+func (ts *TesterServer) rejectRESP(conn net.Conn) {
+	w := bufio.NewWriter(conn)
+	writeReply(w, 2, respError("ERR max number of clients reached"))
+	w.Flush()
+}
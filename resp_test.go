@@ -0,0 +1,283 @@
+package skv
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Al0ha0e/skv/transaction"
+)
+
+type respTestClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *respReader
+}
+
+func dialRESP(t *testing.T, url string) *respTestClient {
+	conn, err := net.Dial("tcp", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &respTestClient{t: t, conn: conn, r: &respReader{r: bufio.NewReader(conn)}}
+}
+
+func (c *respTestClient) do(args ...string) interface{} {
+	c.t.Helper()
+	msg := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		msg += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := c.conn.Write([]byte(msg)); err != nil {
+		c.t.Fatal(err)
+	}
+	v, err := c.r.value()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return v
+}
+
+func (c *respTestClient) expect(want interface{}, args ...string) {
+	c.t.Helper()
+	if got := c.do(args...); !reflect.DeepEqual(got, want) {
+		c.t.Fatalf("%v: expected %#v, got %#v", args, want, got)
+	}
+}
+
+func startRESPServer(t *testing.T, path string, url string) *TesterServer {
+	server := makeTestServer(t, path, "")
+	go func() {
+		server.RunRESP(url)
+	}()
+	for i := 0; i < 100; i++ {
+		conn, err := net.Dial("tcp", url)
+		if err == nil {
+			conn.Close()
+			return server
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("RESP listener did not start")
+	return nil
+}
+
+func TestRESPCommands(t *testing.T) {
+	server := startRESPServer(t, "./testdata/resp.skv", "127.0.0.1:20008")
+	defer server.Stop()
+
+	c := dialRESP(t, "127.0.0.1:20008")
+	defer c.conn.Close()
+
+	c.expect(respStatus("PONG"), "PING")
+	c.expect(respStatus("OK"), "SET", "a", "1")
+	c.expect([]byte("1"), "GET", "a")
+	c.expect(nil, "GET", "missing")
+	c.expect(int64(11), "INCRBY", "a", "10")
+	c.expect(int64(-1), "DECR", "counter")
+	c.expect(respStatus("OK"), "SET", "s", "text")
+	c.expect(respError("ERR value is not an integer or out of range"), "INCRBY", "s", "1")
+	c.expect(int64(2), "EXISTS", "a", "s", "missing")
+	c.expect(int64(1), "DEL", "s", "missing")
+	c.expect(respError("ERR unknown command 'NOPE'"), "NOPE")
+
+	c.expect(respStatus("OK"), "SET", "user:1", "x")
+	c.expect(respStatus("OK"), "SET", "user:2", "y")
+	cursor := encodeRespCursor([]byte("counter"))
+	c.expect([]interface{}{[]byte(cursor), []interface{}{[]byte("a")}}, "SCAN", "0", "COUNT", "2", "MATCH", "[a-b]")
+	c.expect(respStatus("OK"), "SET", "b", "z")
+	c.expect([]interface{}{[]byte("0"), []interface{}{[]byte("user:1"), []byte("user:2")}}, "SCAN", cursor, "MATCH", "user:*")
+	c.expect(respError("ERR invalid cursor"), "SCAN", "2")
+
+	if value, _ := server.db.Get([]byte("a")); string(value) != "11" {
+		t.Fatal("bad value", value)
+	}
+
+	c.expect([]interface{}{}, "COMMAND", "DOCS")
+	hello := c.do("HELLO", "3")
+	if items, ok := hello.([]interface{}); !ok || len(items) != 12 {
+		t.Fatal("bad HELLO reply", hello)
+	}
+	c.expect(nil, "GET", "missing")
+}
+
+func TestRESPTransaction(t *testing.T) {
+	server := startRESPServer(t, "./testdata/resptx.skv", "127.0.0.1:20009")
+	defer server.Stop()
+
+	c1 := dialRESP(t, "127.0.0.1:20009")
+	defer c1.conn.Close()
+	c2 := dialRESP(t, "127.0.0.1:20009")
+	defer c2.conn.Close()
+
+	c1.expect(respStatus("OK"), "MULTI")
+	c1.expect(respStatus("QUEUED"), "SET", "a", "1")
+	c1.expect(respStatus("QUEUED"), "INCR", "a")
+	c1.expect(respStatus("QUEUED"), "GET", "a")
+	c2.expect(nil, "GET", "a")
+	c1.expect([]interface{}{respStatus("OK"), int64(2), []byte("2")}, "EXEC")
+	c2.expect([]byte("2"), "GET", "a")
+
+	c1.expect(respStatus("OK"), "MULTI")
+	c1.expect(respStatus("QUEUED"), "SET", "a", "3")
+	c1.expect(respStatus("OK"), "DISCARD")
+	c1.expect([]byte("2"), "GET", "a")
+
+	// a command failing to queue fails the whole transaction
+	c1.expect(respStatus("OK"), "MULTI")
+	c1.expect(respError("ERR wrong number of arguments for 'set' command"), "SET", "a")
+	c1.expect(respError("EXECABORT Transaction discarded because of previous errors."), "EXEC")
+
+	// a watched key changed by another client aborts EXEC
+	c1.expect(respStatus("OK"), "WATCH", "a")
+	c2.expect(respStatus("OK"), "SET", "a", "5")
+	c1.expect(respStatus("OK"), "MULTI")
+	c1.expect(respStatus("QUEUED"), "SET", "a", "6")
+	c1.expect(respNullArray{}, "EXEC")
+	c1.expect([]byte("5"), "GET", "a")
+
+	c1.expect(respStatus("OK"), "WATCH", "a")
+	c1.expect(respStatus("OK"), "MULTI")
+	c1.expect(respStatus("QUEUED"), "SET", "a", "6")
+	c1.expect([]interface{}{respStatus("OK")}, "EXEC")
+	c1.expect([]byte("6"), "GET", "a")
+}
+
+func TestRESPReaderLimits(t *testing.T) {
+	for _, input := range []string{
+		"*99999999999999999\r\n",
+		"%4611686018427387904\r\n",
+		"*2000000\r\n",
+		strings.Repeat("*1\r\n", respMaxDepth+1) + "$1\r\na\r\n",
+		":" + strings.Repeat("1", respMaxInline) + "\r\n",
+	} {
+		rr := &respReader{r: bufio.NewReader(strings.NewReader(input))}
+		if _, err := rr.value(); err != errRespProtocol {
+			t.Errorf("%.20q: expected a protocol error, got %v", input, err)
+		}
+	}
+
+	rr := &respReader{r: bufio.NewReader(strings.NewReader(strings.Repeat("*1\r\n", respMaxDepth) + "$1\r\na\r\n"))}
+	if _, err := rr.value(); err != nil {
+		t.Fatal(err)
+	}
+
+	rr = &respReader{r: bufio.NewReader(strings.NewReader("GET " + strings.Repeat("a", respMaxInline) + "\r\n"))}
+	if _, err := rr.command(); err != errRespProtocol {
+		t.Error("expected a protocol error for a long inline command, got", err)
+	}
+	rr = &respReader{r: bufio.NewReader(strings.NewReader("GET " + strings.Repeat("a", respMaxInline-8) + "\r\n"))}
+	if args, err := rr.command(); err != nil || len(args[1]) != respMaxInline-8 {
+		t.Error("inline command within the limit refused", err)
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	cases := []struct {
+		pattern string
+		s       string
+		match   bool
+	}{
+		{"*", "", true},
+		{"user:*", "user:42", true},
+		{"user:*", "users", false},
+		{"h?llo", "hello", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"a\\*", "a*", true},
+		{"a\\*", "ab", false},
+		{"*o*o", "foo/bar/zoo", true},
+	}
+	for _, c := range cases {
+		if globMatch([]byte(c.pattern), []byte(c.s)) != c.match {
+			t.Error(c.pattern, c.s, !c.match)
+		}
+	}
+}
+
+func TestRESPAuth(t *testing.T) {
+	server := makeTestServer(t, "./testdata/respauth.skv", "")
+	server.RequireAuth = true
+	server.db.SetUser("alice", "secret", []Grant{{Prefix: "a", Perms: PermRead | PermWrite}})
+	token, _ := server.db.NewToken("alice")
+	server.db.Put([]byte("b"), []byte("1"))
+	go func() {
+		server.RunRESP("127.0.0.1:20019")
+	}()
+	waitForServer(t, "127.0.0.1:20019")
+	defer server.Stop()
+
+	c := dialRESP(t, "127.0.0.1:20019")
+	defer c.conn.Close()
+	c.expect(respError("NOAUTH Authentication required."), "GET", "a")
+	c.expect(respError("WRONGPASS invalid username-password pair or user is disabled."), "AUTH", "alice", "guess")
+	c.expect(respStatus("OK"), "AUTH", "alice", "secret")
+	c.expect(respStatus("OK"), "SET", "a", "1")
+	c.expect(respError("NOPERM permission denied"), "GET", "b")
+	c.expect([]interface{}{[]byte("0"), []interface{}{[]byte("a")}}, "SCAN", "0")
+
+	c.expect(respStatus("OK"), "MULTI")
+	c.expect(respStatus("QUEUED"), "INCR", "a")
+	c.expect(respStatus("QUEUED"), "INCR", "b")
+	c.expect([]interface{}{int64(2), respError("NOPERM permission denied")}, "EXEC")
+
+	c2 := dialRESP(t, "127.0.0.1:20019")
+	defer c2.conn.Close()
+	c2.expect(respStatus("OK"), "AUTH", token)
+	c2.expect([]byte("2"), "GET", "a")
+
+	// HELLO goes through before authenticating, and may authenticate
+	c3 := dialRESP(t, "127.0.0.1:20019")
+	defer c3.conn.Close()
+	if reply, ok := c3.do("HELLO", "3").(respError); !ok || !strings.HasPrefix(string(reply), "NOAUTH") {
+		t.Fatal("HELLO served without authentication", reply)
+	}
+	c3.expect(respError("WRONGPASS invalid username-password pair or user is disabled."), "HELLO", "3", "AUTH", "alice", "guess")
+	if reply := c3.do("HELLO", "3", "AUTH", "alice", "secret", "SETNAME", "c3"); len(reply.([]interface{})) != 12 {
+		t.Fatal("bad HELLO reply", reply)
+	}
+	c3.expect([]byte("2"), "GET", "a")
+}
+
+func TestRESPCancelWaitOnDisconnect(t *testing.T) {
+	server := startRESPServer(t, "./testdata/respwait.skv", "127.0.0.1:20022")
+	defer server.Stop()
+	server.db.lm.Policy = transaction.LockPolicyDetect
+
+	holder, err := server.db.StartTransaction(transaction.TxOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	holder.Put(context.Background(), []byte("a"), []byte("1"))
+
+	c := dialRESP(t, "127.0.0.1:20022")
+	c.conn.Write([]byte("*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n2\r\n"))
+	time.Sleep(50 * time.Millisecond)
+	c.conn.Close()
+
+	// the lock wait of the client gone is canceled, ending its connection
+	for i := 0; ; i++ {
+		server.lock.Lock()
+		conns := len(server.conns)
+		server.lock.Unlock()
+		if conns == 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("lock wait outlived the client")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := holder.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := server.db.Get([]byte("a")); string(v) != "1" {
+		t.Error("write of the client gone applied", v)
+	}
+}
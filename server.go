@@ -2,10 +2,14 @@ package skv
 
 import (
 	"bytes"
-	"encoding/binary"
-	"encoding/gob"
-	"fmt"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
 	"net"
+	"net/http"
+	"sync"
+	"time"
 
 	"github.com/Al0ha0e/skv/transaction"
 )
@@ -20,12 +24,27 @@ const (
 	OPTXSTART
 	OPCOMMIT
 	OPABORT
+	OPSAVEPOINT
+	OPROLLBACKTO
+	OPAUTH
 )
 
+// flags carried in the value of OPTXSTART above the isolation level
+const (
+	TxFlagReadOnly int32 = 1 << 8
+)
+
+// Operation is a request sent to the server. Key may hold arbitrary bytes.
+// Data carries the value of the operation; when it is nil the int32 Value is
+// sent in its place, which is all the legacy protocol can carry.
 type Operation struct {
+	ID    uint32
+	Tx    uint32 // transaction handle, 0 for the implicit transaction
 	OP    OPType
+	Flags uint8
 	Key   string
 	Value int32
+	Data  []byte
 }
 
 func MakeOperation(op OPType, key string, value int32) Operation {
@@ -36,15 +55,54 @@ func MakeOperation(op OPType, key string, value int32) Operation {
 	}
 }
 
+// OperationResult is the reply to an Operation. Bit 1 of State tells the
+// operation succeeded, bit 0 that a value was found, in which case it is in
+// Data, and in Value as well when it is 4 bytes long. A failed operation
+// carries the code and message of its error, see Err.
 type OperationResult struct {
-	Value int32
-	State int8
+	ID      uint32
+	Tx      uint32
+	Value   int32
+	State   int8
+	Flags   uint8
+	Data    []byte
+	Code    ErrorCode
+	Message string
 }
 
+const (
+	DefaultIdleTimeout  = 5 * time.Minute
+	DefaultReadTimeout  = 30 * time.Second
+	DefaultWriteTimeout = 30 * time.Second
+	DefaultMaxConns     = 1024
+
+	rejectTimeout = time.Second
+)
+
+var (
+	ErrServerClosed = errors.New("server closed")
+	ErrOverloaded   = errors.New("server overloaded, too many connections")
+)
+
 type TesterServer struct {
-	db       *DB
-	url      string
-	listener net.Listener
+	db           *DB
+	url          string
+	listener     net.Listener
+	respListener net.Listener
+	httpServer   *http.Server
+	IdleTimeout  time.Duration // wait for the next request, the open transaction is aborted past it
+	ReadTimeout  time.Duration // read of a request once its first byte came
+	WriteTimeout time.Duration // write of a reply
+	Protocol     Protocol
+	MaxInFlight  int         // direct requests of a connection run at once
+	MaxConns     int         // connections served at once, over all listeners, 0 for no limit
+	TLSConfig    *tls.Config // serves every listener over TLS when set, see ServerTLSConfig
+	RequireAuth  bool        // clients must authenticate first, as a user set with DB.SetUser
+	conns        map[net.Conn]context.CancelFunc
+	requests     map[*http.Request]context.CancelFunc // HTTP requests being served
+	running      sync.WaitGroup                       // connection goroutines and HTTP requests
+	shutdown     bool
+	lock         sync.Mutex // guards the listeners, conns, requests and shutdown
 }
 
 func MakeTestServer(path string, url string) (*TesterServer, error) {
@@ -53,152 +111,457 @@ func MakeTestServer(path string, url string) (*TesterServer, error) {
 		return nil, err
 	}
 	return &TesterServer{
-		db:  db,
-		url: url,
+		db:           db,
+		url:          url,
+		IdleTimeout:  DefaultIdleTimeout,
+		ReadTimeout:  DefaultReadTimeout,
+		WriteTimeout: DefaultWriteTimeout,
+		MaxInFlight:  DefaultMaxInFlight,
+		MaxConns:     DefaultMaxConns,
+		conns:        make(map[net.Conn]context.CancelFunc),
+		requests:     make(map[*http.Request]context.CancelFunc),
 	}, nil
 }
 
-func (ts *TesterServer) send(conn net.Conn, value int32, state int8) error {
-	pack := OperationResult{
-		Value: value,
-		State: state,
+func (ts *TesterServer) send(conn net.Conn, res OperationResult) error {
+	ts.writing(conn)
+	return writeResponse(conn, ts.Protocol, res)
+}
+
+// next reads the next request off conn. The idle timeout armed by await runs
+// until its first byte comes, the read timeout from then on.
+func (ts *TesterServer) next(conn net.Conn) (Operation, error) {
+	var first [1]byte
+	if _, err := io.ReadFull(conn, first[:]); err != nil {
+		return Operation{}, err
+	}
+	ts.reading(conn)
+	return readRequest(io.MultiReader(bytes.NewReader(first[:]), conn), ts.Protocol)
+}
+
+// result builds the reply to the operation id, which found value if it is
+// not nil, and failed if err is not nil.
+func result(id uint32, value []byte, err error) OperationResult {
+	res := OperationResult{
+		ID:    id,
+		State: 2,
+		Data:  value,
+	}
+	if value != nil {
+		res.State = 3
 	}
-	buf := &bytes.Buffer{}
-	binary.Write(buf, binary.BigEndian, pack)
-	_, err := conn.Write(buf.Bytes())
 	if err != nil {
-		return err
+		res.State &^= 2
+		res.Code = errorCode(err)
+		res.Message = err.Error()
 	}
+	return res
+}
 
-	return nil
+// opPerms are the permissions each operation needs on its key.
+var opPerms = map[OPType]Perm{
+	OPGET: PermRead,
+	OPPUT: PermWrite,
+	OPDEL: PermWrite,
+	OPINC: PermRead | PermWrite,
 }
 
-func (ts *TesterServer) processDirect(pack Operation) (int32, int8) {
+// authenticate checks the credentials of OPAUTH: a user name in its key and
+// a password in its value, or an empty key and a token.
+func (ts *TesterServer) authenticate(pack Operation) (*User, error) {
+	if pack.Key == "" {
+		return ts.db.AuthenticateToken(string(pack.Data))
+	}
+	return ts.db.Authenticate(pack.Key, string(pack.Data))
+}
+
+// processDirect runs pack outside of any transaction, as user, or as anyone
+// when user is nil.
+func (ts *TesterServer) processDirect(pack Operation, user *User) OperationResult {
 	key := []byte(pack.Key)
+	if err := authorize(user, key, opPerms[pack.OP]); err != nil {
+		return result(pack.ID, nil, err)
+	}
 
-	ivalue := int32(0)
-	has := false
+	var value []byte
+	var err error
 
 	switch pack.OP {
 	case OPGET:
-		value, _ := ts.db.Get(key)
-		if value != nil {
-			has = true
-			binary.Read(bytes.NewBuffer(value), binary.BigEndian, &ivalue)
-		}
+		value, err = ts.db.Get(key)
 	case OPPUT:
-		buf := &bytes.Buffer{}
-		binary.Write(buf, binary.BigEndian, pack.Value)
-		ts.db.Put(key, buf.Bytes())
+		err = ts.db.Put(key, pack.Data)
 	case OPDEL:
-		ts.db.Delete(key)
+		err = ts.db.Delete(key)
 	case OPINC:
-		ts.db.Increase32(key, pack.Value)
+		if len(pack.Data) != 4 {
+			err = ErrBadValue
+		} else {
+			err = ts.db.Increase32(key, pack.Value)
+		}
+	case OPSAVEPOINT, OPROLLBACKTO, OPCOMMIT, OPABORT:
+		err = transaction.ErrNotRunning
+	default:
+		err = ErrUnknownOP
 	}
 
-	state := int8(2)
-	if has {
-		state += 1
-	}
-	return ivalue, state
+	return result(pack.ID, value, err)
 }
 
-func (ts *TesterServer) processTx(pack Operation, tx transaction.Transaction) (int32, int8) {
+// processTx runs pack in tx, as user, or as anyone when user is nil.
+func (ts *TesterServer) processTx(ctx context.Context, pack Operation, tx transaction.Transaction, user *User) OperationResult {
 	key := []byte(pack.Key)
+	if err := authorize(user, key, opPerms[pack.OP]); err != nil {
+		return result(pack.ID, nil, err)
+	}
 
-	ivalue := int32(0)
-	has := false
+	var value []byte
 	var err error
 
 	switch pack.OP {
 	case OPGET:
-		var value []byte
-		value, err = tx.Get(key)
-		if value != nil {
-			has = true
-			binary.Read(bytes.NewBuffer(value), binary.BigEndian, &ivalue)
-		}
+		value, err = tx.Get(ctx, key)
 	case OPPUT:
-		buf := &bytes.Buffer{}
-		binary.Write(buf, binary.BigEndian, pack.Value)
-		err = tx.Put(key, buf.Bytes())
+		err = tx.Put(ctx, key, pack.Data)
 	case OPDEL:
-		err = tx.Delete(key)
+		err = tx.Delete(ctx, key)
 	case OPINC:
-		err = tx.Increase32(key, pack.Value)
+		if len(pack.Data) != 4 {
+			err = ErrBadValue
+		} else {
+			err = tx.Increase32(ctx, key, pack.Value)
+		}
 	case OPCOMMIT:
 		err = tx.Commit()
 	case OPABORT:
 		err = tx.Abort()
+	case OPSAVEPOINT:
+		err = tx.Savepoint(pack.Key)
+	case OPROLLBACKTO:
+		err = tx.RollbackTo(pack.Key)
+	default:
+		err = ErrUnknownOP
 	}
 
-	state := int8(0)
-	if has {
-		state = 1
-	}
-	if err == nil {
-		state += 2
+	return result(pack.ID, value, err)
+}
+
+// ended tells whether err, failing an operation of a transaction, ended the
+// transaction as well: conflicts, timeouts and cancellations abort it. Any
+// other error, such as a missing savepoint or a refused key, only fails the
+// operation, and the transaction goes on.
+func ended(err error) bool {
+	return transaction.Retryable(err) ||
+		errors.Is(err, transaction.ErrTxTimeout) ||
+		errors.Is(err, transaction.ErrNotRunning) ||
+		errors.Is(err, context.Canceled) ||
+		errors.Is(err, context.DeadlineExceeded)
+}
+
+// txOptions reads the options of OPTXSTART from its value: the isolation
+// level in the low byte, and flags above it.
+func txOptions(pack Operation) transaction.TxOptions {
+	return transaction.TxOptions{
+		Isolation: transaction.IsolationLevel(pack.Value & 0xff),
+		ReadOnly:  pack.Value&TxFlagReadOnly != 0,
 	}
-	return ivalue, state
 }
 
-func (ts *TesterServer) process(conn net.Conn) {
-	defer conn.Close()
-	isTx := false
-	var tx transaction.Transaction
-	for {
-		pack := Operation{}
-		decoder := gob.NewDecoder(conn)
-		err := decoder.Decode(&pack)
-		// err := binary.Read(conn, binary.BigEndian, &pack)
+// read reads the requests of conn for process until done is closed. Reading
+// on while process waits is how a client disconnecting or going idle is seen
+// in time to cancel the requests it left, and the locks they wait for.
+func (ts *TesterServer) read(conn net.Conn, reqs chan<- Operation, done <-chan struct{}) {
+	defer close(reqs)
+	for ts.await(conn) {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		pack, err := ts.next(conn)
 		if err != nil {
-			fmt.Println(err)
-			break
+			ts.hangUp(conn, done)
+			return
+		}
+		select {
+		case reqs <- pack:
+		case <-done:
+			return
 		}
+	}
+}
 
-		if pack.OP == OPTXSTART {
-			isTx = true
-			tx = ts.db.StartTransaction()
-			ts.send(conn, 0, 2)
+// hangUp cancels what conn still runs once its client is gone, unless the
+// connection is being closed from this side.
+func (ts *TesterServer) hangUp(conn net.Conn, done <-chan struct{}) {
+	select {
+	case <-done:
+	default:
+		if !ts.closing() {
+			// no one waits for the replies, stop waiting for locks
+			ts.cancel(conn)
+		}
+	}
+}
+
+func (ts *TesterServer) process(ctx context.Context, conn net.Conn) {
+	p := makePipeline(ctx, ts, conn)
+	reqs := make(chan Operation)
+	done := make(chan struct{})
+	read := make(chan struct{})
+	go func() {
+		ts.read(conn, reqs, done)
+		close(read)
+	}()
+
+	var user *User
+	// a client that disconnects or goes idle must not keep its locks
+	defer func() {
+		if !ts.closing() {
+			ts.cancel(conn)
+		}
+		close(done)
+		// wake up the reader, it may still wait for a request
+		conn.SetReadDeadline(time.Now())
+		<-read
+		p.close()
+		ts.untrack(conn)
+	}()
+
+	for pack := range reqs {
+		if pack.OP == OPAUTH {
+			// the requests sent before still run as who sent them
+			authed, err := ts.authenticate(pack)
+			p.send(result(pack.ID, nil, err))
+			if err != nil {
+				// no second guess on the same connection
+				break
+			}
+			user = authed
 			continue
 		}
+		if ts.RequireAuth && user == nil {
+			p.send(result(pack.ID, nil, ErrUnauthenticated))
+			break
+		}
 
-		// fmt.Println(pack)
-		var ivalue int32
-		var state int8
-		if isTx {
-			ivalue, state = ts.processTx(pack, tx)
-		} else {
-			ivalue, state = ts.processDirect(pack)
+		switch {
+		case pack.OP == OPTXSTART && pack.Flags&FlagNewTx != 0:
+			p.send(p.begin(pack))
+		case pack.OP == OPTXSTART:
+			p.start(pack)
+		case pack.Tx != implicitTx || p.inTx():
+			p.processTx(pack, user)
+		default:
+			p.processDirect(pack, user)
 		}
+	}
+}
 
-		if pack.OP == OPABORT || pack.OP == OPCOMMIT || state&2 == 0 {
-			isTx = false
-			tx = nil
+// serve accepts connections on l until the server shuts down, handling each
+// of them in its own goroutine. Past MaxConns, connections are handed to
+// reject instead, which tells the client to back off.
+func (ts *TesterServer) serve(l net.Listener, handle func(ctx context.Context, conn net.Conn), reject func(conn net.Conn)) error {
+	delay := time.Duration(0)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ts.closing() {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				// out of file descriptors and the like, back off for a while
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay < time.Second {
+					delay *= 2
+				}
+				time.Sleep(delay)
+				continue
+			}
+			return err
 		}
+		delay = 0
 
-		ts.send(conn, ivalue, state)
+		ctx, cancel := context.WithCancel(context.Background())
+		if err = ts.track(conn, cancel); err != nil {
+			cancel()
+			if err == ErrOverloaded {
+				// answered in the background, a TLS handshake may take a
+				// while, but never past rejectTimeout
+				conn.SetDeadline(time.Now().Add(rejectTimeout))
+				go func() {
+					reject(conn)
+					conn.Close()
+				}()
+				continue
+			}
+			conn.Close()
+			return err
+		}
+		go handle(ctx, conn)
 	}
+}
 
+// listen opens a listener on url, unless the server is shutting down.
+func (ts *TesterServer) listen(url string, l *net.Listener) error {
+	listener, err := net.Listen("tcp", url)
+	if err != nil {
+		return err
+	}
+	if ts.TLSConfig != nil {
+		listener = tls.NewListener(listener, ts.TLSConfig)
+	}
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	if ts.shutdown {
+		listener.Close()
+		return ErrServerClosed
+	}
+	*l = listener
+	return nil
 }
 
-func (ts *TesterServer) Run() error {
+// track registers a connection until its goroutine is done with it, see
+// untrack.
+func (ts *TesterServer) track(conn net.Conn, cancel context.CancelFunc) error {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	if ts.shutdown {
+		return ErrServerClosed
+	}
+	if ts.MaxConns > 0 && len(ts.conns) >= ts.MaxConns {
+		return ErrOverloaded
+	}
+	ts.conns[conn] = cancel
+	ts.running.Add(1)
+	return nil
+}
 
-	l, err := net.Listen("tcp", ts.url)
-	ts.listener = l
-	if err != nil {
+func (ts *TesterServer) untrack(conn net.Conn) {
+	ts.lock.Lock()
+	cancel := ts.conns[conn]
+	delete(ts.conns, conn)
+	ts.lock.Unlock()
+
+	cancel()
+	conn.Close()
+	ts.running.Done()
+}
+
+// cancel cancels the context of the requests of conn.
+func (ts *TesterServer) cancel(conn net.Conn) {
+	ts.lock.Lock()
+	cancel := ts.conns[conn]
+	ts.lock.Unlock()
+	cancel()
+}
+
+func (ts *TesterServer) closing() bool {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	return ts.shutdown
+}
+
+// await arms the idle timeout before the next request is read from conn,
+// telling whether the connection should still be served.
+func (ts *TesterServer) await(conn net.Conn) bool {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	if ts.IdleTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(ts.IdleTimeout))
+	}
+	return !ts.shutdown
+}
+
+// reading arms the read timeout of conn, once a request started coming.
+func (ts *TesterServer) reading(conn net.Conn) {
+	if ts.ReadTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(ts.ReadTimeout))
+	}
+}
+
+// writing arms the write timeout of conn before a reply is sent, so that a
+// client not reading its replies cannot hold the connection forever.
+func (ts *TesterServer) writing(conn net.Conn) {
+	if ts.WriteTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(ts.WriteTimeout))
+	}
+}
+
+// reject tells a client over MaxConns to come back later.
+func (ts *TesterServer) reject(conn net.Conn) {
+	writeResponse(conn, ts.Protocol, result(0, nil, ErrOverloaded))
+}
+
+func (ts *TesterServer) Run() error {
+	if err := ts.listen(ts.url, &ts.listener); err != nil {
 		return err
 	}
+	return ts.serve(ts.listener, ts.process, ts.reject)
+}
 
-	for {
-		conn, err := ts.listener.Accept()
-		if err == nil {
-			go ts.process(conn)
+// Shutdown stops the server gracefully. It stops accepting connections and
+// HTTP requests, lets the requests being run finish, aborts the transactions
+// left open, waits for every connection and HTTP request to be done, then
+// closes the DB. If ctx is done first, the remaining requests are canceled
+// and their connections closed at once, and ctx.Err() is returned once they
+// are gone.
+func (ts *TesterServer) Shutdown(ctx context.Context) error {
+	ts.lock.Lock()
+	if ts.shutdown {
+		ts.lock.Unlock()
+		return ErrServerClosed
+	}
+	ts.shutdown = true
+	if ts.listener != nil {
+		ts.listener.Close()
+	}
+	if ts.respListener != nil {
+		ts.respListener.Close()
+	}
+	// wake up the connections waiting for a request
+	for conn := range ts.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	httpServer := ts.httpServer
+	ts.lock.Unlock()
+
+	var err error
+	if httpServer != nil {
+		if err = httpServer.Shutdown(ctx); err != nil {
+			httpServer.Close()
 		}
 	}
+
+	done := make(chan struct{})
+	go func() {
+		ts.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		ts.lock.Lock()
+		for conn, cancel := range ts.conns {
+			cancel()
+			conn.Close()
+		}
+		for _, cancel := range ts.requests {
+			cancel()
+		}
+		ts.lock.Unlock()
+		<-done
+	}
+
+	ts.db.Close()
+	return err
 }
 
+// Stop shuts the server down without waiting for the requests being run.
 func (ts *TesterServer) Stop() {
-	ts.listener.Close()
-	ts.db.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ts.Shutdown(ctx)
 }
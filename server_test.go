@@ -1,10 +1,18 @@
 package skv
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
 	"os"
+	"strconv"
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/Al0ha0e/skv/storage"
+	"github.com/Al0ha0e/skv/transaction"
 )
 
 func TestParseCase(t *testing.T) {
@@ -297,3 +305,624 @@ func TestCase5(t *testing.T) {
 	}
 	client.Stop()
 }
+
+func makeTestServer(t *testing.T, path string, url string) *TesterServer {
+	os.Remove(path)
+	server, err := MakeTestServer(path, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func startTestServer(t *testing.T, server *TesterServer, url string) {
+	go func() {
+		server.Run()
+	}()
+	waitForServer(t, url)
+}
+
+func waitForServer(t *testing.T, url string) {
+	for i := 0; i < 100; i++ {
+		conn, err := net.Dial("tcp", url)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("server did not start")
+}
+
+func TestAbortOnDisconnect(t *testing.T) {
+	server := makeTestServer(t, "./testdata/disconnect.skv", "127.0.0.1:20001")
+	startTestServer(t, server, "127.0.0.1:20001")
+	defer server.Stop()
+
+	client1 := MakeTestClient("127.0.0.1:20001")
+	client1.Run()
+	client1.Operate(OPTXSTART, "", 0)
+	if res := client1.Operate(OPPUT, "A", 1); res.State&2 == 0 {
+		t.Fatal("put failed", res)
+	}
+	client1.Stop()
+	time.Sleep(50 * time.Millisecond)
+
+	client2 := MakeTestClient("127.0.0.1:20001")
+	client2.Run()
+	defer client2.Stop()
+	client2.Operate(OPTXSTART, "", 0)
+	if res := client2.Operate(OPPUT, "A", 2); res.State&2 == 0 {
+		t.Fatal("lock of disconnected client still held", res)
+	}
+	client2.Operate(OPCOMMIT, "", 0)
+}
+
+func TestCancelWaitOnDisconnect(t *testing.T) {
+	server := makeTestServer(t, "./testdata/disconnectwait.skv", "127.0.0.1:20021")
+	server.db.lm.Policy = transaction.LockPolicyDetect
+	// requests run one at a time, in the goroutine reading them
+	server.MaxInFlight = 1
+	startTestServer(t, server, "127.0.0.1:20021")
+	defer server.Stop()
+
+	client1 := MakeTestClient("127.0.0.1:20021")
+	client1.Run()
+	defer client1.Stop()
+	client1.Operate(OPTXSTART, "", 0)
+	client1.Operate(OPPUT, "A", 1)
+
+	client2 := MakeTestClient("127.0.0.1:20021")
+	client2.Run()
+	client2.Operate(OPTXSTART, "", 0)
+	client2.Send(OPPUT, "A", 2)
+	time.Sleep(50 * time.Millisecond)
+	client2.Stop()
+
+	// the lock wait of the client gone is canceled, ending its connection
+	for i := 0; ; i++ {
+		server.lock.Lock()
+		conns := len(server.conns)
+		server.lock.Unlock()
+		if conns == 1 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("lock wait outlived the client")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	client1.Operate(OPCOMMIT, "", 0)
+}
+
+func TestAbortOnIdle(t *testing.T) {
+	server := makeTestServer(t, "./testdata/idle.skv", "127.0.0.1:20002")
+	server.IdleTimeout = 50 * time.Millisecond
+	startTestServer(t, server, "127.0.0.1:20002")
+	defer server.Stop()
+
+	client1 := MakeTestClient("127.0.0.1:20002")
+	client1.Run()
+	defer client1.Stop()
+	client1.Operate(OPTXSTART, "", 0)
+	client1.Operate(OPPUT, "A", 1)
+	time.Sleep(150 * time.Millisecond)
+
+	client2 := MakeTestClient("127.0.0.1:20002")
+	client2.Run()
+	defer client2.Stop()
+	client2.Operate(OPTXSTART, "", 0)
+	if res := client2.Operate(OPPUT, "A", 2); res.State&2 == 0 {
+		t.Fatal("lock of idle client still held", res)
+	}
+	client2.Operate(OPCOMMIT, "", 0)
+}
+
+func TestIsolationLevel(t *testing.T) {
+	server := makeTestServer(t, "./testdata/isolation.skv", "127.0.0.1:20003")
+	startTestServer(t, server, "127.0.0.1:20003")
+	defer server.Stop()
+
+	client1 := MakeTestClient("127.0.0.1:20003")
+	client1.Run()
+	defer client1.Stop()
+	client2 := MakeTestClient("127.0.0.1:20003")
+	client2.Run()
+	defer client2.Stop()
+
+	client2.Operate(OPPUT, "A", 1)
+	if res := client1.Operate(OPTXSTART, "", 42); res.State&2 != 0 {
+		t.Fatal("unknown isolation level accepted", res)
+	}
+	client1.Operate(OPTXSTART, "", int32(transaction.IsolationSnapshot))
+	client1.Operate(OPGET, "A", 0)
+	client2.Operate(OPPUT, "A", 2)
+	if res := client1.Operate(OPGET, "A", 0); res.Value != 1 {
+		t.Fatal("snapshot saw a later write", res)
+	}
+	client1.Operate(OPCOMMIT, "", 0)
+
+	client1.Operate(OPTXSTART, "", TxFlagReadOnly)
+	if res := client1.Operate(OPGET, "A", 0); res.Value != 2 {
+		t.Fatal("bad value", res)
+	}
+	if res := client1.Operate(OPPUT, "A", 3); res.State&2 != 0 {
+		t.Fatal("write accepted in read-only transaction", res)
+	}
+}
+
+func TestSavepointOverWire(t *testing.T) {
+	server := makeTestServer(t, "./testdata/savepoint.skv", "127.0.0.1:20004")
+	startTestServer(t, server, "127.0.0.1:20004")
+	defer server.Stop()
+
+	client := MakeTestClient("127.0.0.1:20004")
+	client.Run()
+	defer client.Stop()
+
+	client.Operate(OPTXSTART, "", 0)
+	client.Operate(OPPUT, "A", 1)
+	client.Operate(OPSAVEPOINT, "sp", 0)
+	client.Operate(OPPUT, "A", 2)
+	if res := client.Operate(OPROLLBACKTO, "sp", 0); res.State&2 == 0 {
+		t.Fatal("rollback failed", res)
+	}
+	client.Operate(OPCOMMIT, "", 0)
+
+	if res := client.Operate(OPGET, "A", 0); res.Value != 1 {
+		t.Fatal("bad value", res)
+	}
+	if res := client.Operate(OPSAVEPOINT, "sp", 0); res.State&2 != 0 {
+		t.Fatal("savepoint accepted outside a transaction", res)
+	}
+}
+
+func TestBinaryValues(t *testing.T) {
+	server := makeTestServer(t, "./testdata/binary.skv", "127.0.0.1:20005")
+	startTestServer(t, server, "127.0.0.1:20005")
+	defer server.Stop()
+
+	client := MakeTestClient("127.0.0.1:20005")
+	client.Run()
+	defer client.Stop()
+
+	key := "k\x00\xff"
+	value := bytes.Repeat([]byte{0, 1, 2, 0xff}, 1<<15)
+	if res := client.OperateData(OPPUT, key, value); res.State&2 == 0 {
+		t.Fatal("put failed", res)
+	}
+	if res := client.OperateData(OPGET, key, nil); res.State != 3 || !bytes.Equal(res.Data, value) {
+		t.Fatal("bad value", res.State, len(res.Data))
+	}
+	if res := client.OperateData(OPGET, "k", nil); res.State != 2 || res.Data != nil {
+		t.Fatal("missing key found", res)
+	}
+
+	client.Operate(OPTXSTART, "", 0)
+	client.OperateData(OPPUT, key, []byte("tx"))
+	if res := client.OperateData(OPGET, key, nil); string(res.Data) != "tx" {
+		t.Fatal("bad value in tx", res)
+	}
+	client.Operate(OPCOMMIT, "", 0)
+}
+
+func TestLegacyProtocol(t *testing.T) {
+	server := makeTestServer(t, "./testdata/legacy.skv", "127.0.0.1:20006")
+	server.Protocol = ProtocolLegacy
+	startTestServer(t, server, "127.0.0.1:20006")
+	defer server.Stop()
+
+	client := MakeTestClient("127.0.0.1:20006")
+	client.Protocol = ProtocolLegacy
+	client.Run()
+	defer client.Stop()
+
+	client.Operate(OPPUT, "A", 7)
+	client.Operate(OPINC, "A", 3)
+	if res := client.Operate(OPGET, "A", 0); res.State != 3 || res.Value != 10 {
+		t.Fatal("bad value", res)
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	server := makeTestServer(t, "./testdata/errors.skv", "127.0.0.1:20007")
+	startTestServer(t, server, "127.0.0.1:20007")
+	defer server.Stop()
+
+	client := MakeTestClient("127.0.0.1:20007")
+	client.Run()
+	defer client.Stop()
+
+	check := func(res OperationResult, target error) {
+		t.Helper()
+		if err := res.Err(); err != target {
+			t.Fatal("expected", target, "got", err, res.Code, res.Message)
+		}
+	}
+
+	check(client.Operate(OPSAVEPOINT, "sp", 0), transaction.ErrNotRunning)
+	check(client.Operate(OPCOMMIT, "", 0), transaction.ErrNotRunning)
+	check(client.Operate(OPTXSTART, "", 42), transaction.ErrBadIsolation)
+	check(client.Operate(OPType(100), "A", 0), ErrUnknownOP)
+	check(client.OperateData(OPINC, "A", []byte{1}), ErrBadValue)
+
+	client.Operate(OPTXSTART, "", 0)
+	client.Operate(OPPUT, "B", 1)
+	res := client.Operate(OPROLLBACKTO, "sp", 0)
+	check(res, transaction.ErrNoSavepoint)
+	if res.Message != transaction.ErrNoSavepoint.Error() {
+		t.Fatal("bad message", res.Message)
+	}
+	// only the operation failed, the transaction goes on
+	check(client.OperateData(OPINC, "B", []byte{1}), ErrBadValue)
+	check(client.Operate(OPCOMMIT, "", 0), nil)
+	if value, _ := server.db.Get([]byte("B")); value == nil {
+		t.Fatal("transaction lost after a failed operation")
+	}
+
+	client.Operate(OPTXSTART, "", TxFlagReadOnly)
+	check(client.Operate(OPPUT, "A", 1), transaction.ErrReadOnlyTx)
+	check(client.Operate(OPGET, "A", 0), nil)
+}
+
+func TestPipelining(t *testing.T) {
+	server := makeTestServer(t, "./testdata/pipeline.skv", "127.0.0.1:20010")
+	startTestServer(t, server, "127.0.0.1:20010")
+	defer server.Stop()
+
+	client := MakeTestClient("127.0.0.1:20010")
+	client.Run()
+	defer client.Stop()
+
+	ops := make([]Operation, 0)
+	for i := 0; i < 100; i++ {
+		key := "k" + strconv.Itoa(i)
+		ops = append(ops, MakeOperation(OPPUT, key, int32(i)))
+		ops = append(ops, MakeOperation(OPINC, key, 1))
+		ops = append(ops, MakeOperation(OPGET, key, 0))
+	}
+	ops = append(ops, MakeOperation(OPTXSTART, "", 0))
+	ops = append(ops, MakeOperation(OPINC, "k0", 10))
+	ops = append(ops, MakeOperation(OPGET, "k0", 0))
+	ops = append(ops, MakeOperation(OPCOMMIT, "", 0))
+
+	results := client.Pipeline(ops)
+	for i := 0; i < 100; i++ {
+		if res := results[3*i+2]; res.State != 3 || res.Value != int32(i+1) {
+			t.Fatal("bad value", i, res)
+		}
+	}
+	if res := results[len(results)-2]; res.Value != 11 {
+		t.Fatal("transaction missed pipelined writes", res)
+	}
+	for _, res := range results {
+		if res.State&2 == 0 {
+			t.Fatal("request failed", res)
+		}
+	}
+
+	// Send and Recv still pair up requests and replies in order
+	client.Send(OPGET, "k1", 0)
+	client.Send(OPGET, "k2", 0)
+	if res := client.Recv(); res.Value != 2 {
+		t.Fatal("bad value", res)
+	}
+	if res := client.Recv(); res.Value != 3 {
+		t.Fatal("bad value", res)
+	}
+}
+
+func TestTransactionHandles(t *testing.T) {
+	server := makeTestServer(t, "./testdata/handles.skv", "127.0.0.1:20011")
+	startTestServer(t, server, "127.0.0.1:20011")
+	defer server.Stop()
+
+	client := MakeTestClient("127.0.0.1:20011")
+	client.Run()
+	defer client.Stop()
+
+	client.Operate(OPPUT, "A", 1)
+	tx1, err := client.Begin(int32(transaction.IsolationSnapshot))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx2, err := client.Begin(0)
+	if err != nil || tx2 == tx1 {
+		t.Fatal("bad handle", tx1, tx2, err)
+	}
+
+	// the transactions interleave over the connection, next to direct
+	// requests and the implicit transaction
+	client.OperateTx(tx1, OPGET, "A", 0)
+	client.OperateTx(tx2, OPPUT, "B", 2)
+	client.Operate(OPPUT, "A", 5)
+	if res := client.OperateTx(tx1, OPGET, "A", 0); res.Value != 1 || res.Tx != tx1 {
+		t.Fatal("snapshot saw a later write", res)
+	}
+	client.Operate(OPTXSTART, "", 0)
+	client.Operate(OPPUT, "C", 3)
+	if res := client.OperateTx(tx2, OPCOMMIT, "", 0); res.State&2 == 0 {
+		t.Fatal("commit failed", res)
+	}
+	client.Operate(OPCOMMIT, "", 0)
+	client.OperateTx(tx1, OPCOMMIT, "", 0)
+
+	if res := client.OperateTx(tx2, OPGET, "B", 0); res.Err() != transaction.ErrNotRunning {
+		t.Fatal("handle still open after commit", res)
+	}
+	if res := client.Operate(OPGET, "B", 0); res.Value != 2 {
+		t.Fatal("bad value", res)
+	}
+	if res := client.Operate(OPGET, "C", 0); res.Value != 3 {
+		t.Fatal("bad value", res)
+	}
+
+	// handles left open are aborted when the connection closes
+	tx3, _ := client.Begin(0)
+	client.OperateTx(tx3, OPPUT, "D", 4)
+	client.Stop()
+	time.Sleep(50 * time.Millisecond)
+	client.Run()
+	tx4, _ := client.Begin(0)
+	if res := client.OperateTx(tx4, OPPUT, "D", 5); res.State&2 == 0 {
+		t.Fatal("lock of closed handle still held", res)
+	}
+}
+
+func TestLockWaitInPipeline(t *testing.T) {
+	server := makeTestServer(t, "./testdata/lockwait.skv", "127.0.0.1:20020")
+	server.db.lm.Policy = transaction.LockPolicyDetect
+	server.MaxInFlight = 2
+	startTestServer(t, server, "127.0.0.1:20020")
+	defer server.Stop()
+
+	client := MakeTestClient("127.0.0.1:20020")
+	client.Run()
+	defer client.Stop()
+
+	tx1, _ := client.Begin(0)
+	tx2, _ := client.Begin(0)
+	client.OperateTx(tx1, OPPUT, "A", 1)
+
+	// the implicit transaction and another handle wait for the lock of tx1,
+	// holding every slot, and the commit releasing it must still get through
+	client.Operate(OPTXSTART, "", 0)
+	put := client.Go(MakeOperation(OPPUT, "A", 2))
+	pack := MakeOperation(OPPUT, "A", 3)
+	pack.Tx = tx2
+	putTx := client.Go(pack)
+	pack = MakeOperation(OPCOMMIT, "", 0)
+	pack.Tx = tx1
+	commit := client.Go(pack)
+
+	select {
+	case res := <-commit:
+		if res.State&2 == 0 {
+			t.Fatal("commit failed", res)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("commit stuck behind the lock waits")
+	}
+	// either may get the lock next, the commit of the other has to wait
+	// for it
+	client.Go(MakeOperation(OPCOMMIT, "", 0))
+	client.OperateTx(tx2, OPCOMMIT, "", 0)
+	if res := <-put; res.State&2 == 0 {
+		t.Fatal("implicit transaction failed", res)
+	}
+	if res := <-putTx; res.State&2 == 0 {
+		t.Fatal("handle failed", res)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	server := makeTestServer(t, "./testdata/shutdown.skv", "127.0.0.1:20012")
+	ran := make(chan error, 1)
+	go func() {
+		ran <- server.Run()
+	}()
+	waitForServer(t, "127.0.0.1:20012")
+	committing := make(chan struct{})
+	server.db.OnPreCommit(func(tx transaction.Transaction, writes []storage.KV) error {
+		close(committing)
+		time.Sleep(100 * time.Millisecond)
+		return nil
+	})
+
+	client1 := MakeTestClient("127.0.0.1:20012")
+	client1.Run()
+	defer client1.Stop()
+	client2 := MakeTestClient("127.0.0.1:20012")
+	client2.Run()
+	defer client2.Stop()
+
+	client2.Operate(OPTXSTART, "", 0)
+	client2.Operate(OPPUT, "B", 2)
+	client1.Operate(OPTXSTART, "", 0)
+	client1.Operate(OPPUT, "A", 1)
+	commit := client1.Go(MakeOperation(OPCOMMIT, "", 0))
+	<-committing
+
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if res := <-commit; res.State&2 == 0 {
+		t.Fatal("in-flight commit failed", res)
+	}
+	if err := <-ran; err != ErrServerClosed {
+		t.Fatal("Run did not return", err)
+	}
+	if _, err := net.Dial("tcp", "127.0.0.1:20012"); err == nil {
+		t.Fatal("still accepting connections")
+	}
+
+	db, err := Open("./testdata/shutdown.skv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if value, _ := db.Get([]byte("A")); value == nil {
+		t.Fatal("commit lost")
+	}
+	if value, _ := db.Get([]byte("B")); value != nil {
+		t.Fatal("open transaction committed")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	server := makeTestServer(t, "./testdata/shutdown.skv", "127.0.0.1:20013")
+	startTestServer(t, server, "127.0.0.1:20013")
+	committing := make(chan struct{})
+	server.db.OnPreCommit(func(tx transaction.Transaction, writes []storage.KV) error {
+		close(committing)
+		time.Sleep(200 * time.Millisecond)
+		return nil
+	})
+
+	client := MakeTestClient("127.0.0.1:20013")
+	client.Run()
+	defer client.Stop()
+	client.Operate(OPTXSTART, "", 0)
+	client.Operate(OPPUT, "A", 1)
+	commit := client.Go(MakeOperation(OPCOMMIT, "", 0))
+	<-committing
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatal("expected the shutdown to time out", err)
+	}
+	if res := <-commit; res.State&2 != 0 {
+		t.Fatal("reply sent on a closed connection", res)
+	}
+}
+
+func TestConnectionLimit(t *testing.T) {
+	server := makeTestServer(t, "./testdata/limit.skv", "127.0.0.1:20014")
+	server.MaxConns = 1
+	startTestServer(t, server, "127.0.0.1:20014")
+	defer server.Stop()
+	// let the connection of startTestServer go
+	time.Sleep(50 * time.Millisecond)
+
+	client1 := MakeTestClient("127.0.0.1:20014")
+	client1.Run()
+	if res := client1.Operate(OPPUT, "A", 1); res.State&2 == 0 {
+		t.Fatal("put failed", res)
+	}
+
+	client2 := MakeTestClient("127.0.0.1:20014")
+	client2.Run()
+	defer client2.Stop()
+	if res := client2.Operate(OPGET, "A", 0); !errors.Is(res.Err(), ErrOverloaded) {
+		t.Fatal("connection over the limit served", res)
+	}
+
+	client1.Stop()
+	time.Sleep(50 * time.Millisecond)
+	client3 := MakeTestClient("127.0.0.1:20014")
+	client3.Run()
+	defer client3.Stop()
+	if res := client3.Operate(OPGET, "A", 0); res.Value != 1 {
+		t.Fatal("connection refused once below the limit", res)
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	server := makeTestServer(t, "./testdata/timeout.skv", "127.0.0.1:20015")
+	server.ReadTimeout = 50 * time.Millisecond
+	startTestServer(t, server, "127.0.0.1:20015")
+	defer server.Stop()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:20015")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// a request cut short after its first bytes
+	conn.Write([]byte{ProtocolVersion, 0, 0})
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("reply to a partial request")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("connection with a partial request kept open")
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	server := makeTestServer(t, "./testdata/auth.skv", "127.0.0.1:20018")
+	server.RequireAuth = true
+	server.db.SetUser("alice", "secret", []Grant{
+		{Prefix: "a/", Perms: PermRead | PermWrite},
+		{Prefix: "shared/", Perms: PermRead},
+	})
+	token, err := server.db.NewToken("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.db.Put([]byte("shared/x"), encodeInt32(7))
+	startTestServer(t, server, "127.0.0.1:20018")
+	defer server.Stop()
+
+	anonymous := MakeTestClient("127.0.0.1:20018")
+	anonymous.Run()
+	defer anonymous.Stop()
+	if res := anonymous.Operate(OPGET, "shared/x", 0); !errors.Is(res.Err(), ErrUnauthenticated) {
+		t.Fatal("request served before authentication", res)
+	}
+
+	wrong := MakeTestClient("127.0.0.1:20018")
+	wrong.Run()
+	defer wrong.Stop()
+	if err := wrong.Auth("alice", "guess"); !errors.Is(err, ErrAuthFailed) {
+		t.Fatal("wrong password accepted", err)
+	}
+
+	client := MakeTestClient("127.0.0.1:20018")
+	client.Run()
+	defer client.Stop()
+	if err := client.Auth("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if res := client.Operate(OPPUT, "a/1", 1); res.State&2 == 0 {
+		t.Fatal("granted write refused", res)
+	}
+	if res := client.Operate(OPGET, "shared/x", 0); res.Value != 7 {
+		t.Fatal("granted read refused", res)
+	}
+	if res := client.Operate(OPPUT, "shared/x", 1); !errors.Is(res.Err(), ErrPermission) {
+		t.Fatal("write without permission", res)
+	}
+	if res := client.Operate(OPGET, userPrefix+"alice", 0); !errors.Is(res.Err(), ErrPermission) {
+		t.Fatal("user record readable", res)
+	}
+
+	client.Operate(OPTXSTART, "", 0)
+	client.Operate(OPPUT, "a/2", 2)
+	if res := client.Operate(OPINC, "shared/x", 1); !errors.Is(res.Err(), ErrPermission) {
+		t.Fatal("write without permission in transaction", res)
+	}
+	if res := client.Operate(OPCOMMIT, "", 0); res.State&2 == 0 {
+		t.Fatal("refused operation ended the transaction", res)
+	}
+	if value, _ := server.db.Get([]byte("a/2")); value == nil {
+		t.Fatal("transaction lost after a refused operation")
+	}
+	if value, _ := server.db.Get([]byte("shared/x")); decodeInt32(value) != 7 {
+		t.Fatal("refused write applied", value)
+	}
+
+	tokenClient := MakeTestClient("127.0.0.1:20018")
+	tokenClient.Run()
+	defer tokenClient.Stop()
+	if err := tokenClient.AuthToken(token); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := tokenClient.Begin(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := <-tokenClient.Go(Operation{Tx: tx, OP: OPDEL, Key: "shared/x"}); !errors.Is(res.Err(), ErrPermission) {
+		t.Fatal("delete without permission in transaction handle", res)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"hash/crc32"
 	"io"
 	"os"
@@ -13,15 +14,27 @@ import (
 	"github.com/Al0ha0e/skv/index"
 )
 
+var (
+	ErrCRCMismatch = errors.New("CRC mismatch")
+	ErrTruncated   = errors.New("truncated record")
+)
+
 type StorageHeader struct {
 	CRC       uint32
 	Timestamp int64
 	Info      byte
 }
 
+// tombstone is written as the value size of a deleted key, telling a
+// deletion apart from an empty value.
+const tombstone uint32 = 0xFFFFFFFF
+
 func SerializeSingle(kv KV) []byte {
 	kSize := uint32(len(kv.Key))
 	vSize := uint32(len(kv.Value))
+	if kv.Value == nil {
+		vSize = tombstone
+	}
 
 	var payload bytes.Buffer
 	binary.Write(&payload, binary.BigEndian, kSize)
@@ -93,29 +106,32 @@ func DeserializeSingle(buf io.Reader, check bool, crc uint32) (kv KV, err error)
 	}
 
 	key := make([]byte, kSize)
-	value := make([]byte, vSize)
-
 	n, err := buf.Read(key)
 	if err != nil {
 		return kv, err
 	}
 	if n != int(kSize) {
-		return kv, errors.New("key error")
+		return kv, ErrTruncated
 	}
 
-	n, err = buf.Read(value)
-	if err != nil {
-		return kv, err
-	}
-	if n != int(vSize) {
-		return kv, errors.New("value error")
+	var value []byte
+	if vSize != tombstone {
+		value = make([]byte, vSize)
+		// an empty value is read as well, even at the end of buf
+		_, err = io.ReadFull(buf, value)
+		if err == io.ErrUnexpectedEOF {
+			return kv, ErrTruncated
+		}
+		if err != nil {
+			return kv, err
+		}
 	}
 
 	if check {
 		payload := SerializeSingle(KV{key, value})
 
 		if crc32.ChecksumIEEE(payload) != crc {
-			return kv, errors.New("CRC mismatch")
+			return kv, ErrCRCMismatch
 		}
 	}
 
@@ -147,7 +163,7 @@ func DeserializeMulti(buf io.Reader, check bool, crc uint32) (kvs []KV, err erro
 	if check {
 		payload := SerializeMulti(kvs)
 		if crc32.ChecksumIEEE(payload) != crc {
-			return kvs, errors.New("CRC mismatch")
+			return kvs, ErrCRCMismatch
 		}
 	}
 
@@ -155,56 +171,113 @@ func DeserializeMulti(buf io.Reader, check bool, crc uint32) (kvs []KV, err erro
 }
 
 func Deserialize(buf io.Reader) (kvs []KV, err error) {
+	records, _, err := DeserializeLog(buf)
+	if err != nil {
+		return nil, err
+	}
+	kvs = make([]KV, 0, len(records))
+	for _, rec := range records {
+		kvs = append(kvs, rec.KV)
+	}
+	return kvs, nil
+}
+
+func stampAll(ts uint64, kvs []KV) []Record {
+	ret := make([]Record, 0, len(kvs))
+	for _, kv := range kvs {
+		ret = append(ret, Record{KV: kv, TS: ts})
+	}
+	return ret
+}
+
+// DeserializeLog returns the pairs to replay from a log, each with the
+// timestamp it was committed at, along with the highest commit timestamp
+// found in it.
+func DeserializeLog(buf io.Reader) (records []Record, maxTS uint64, err error) {
 	// fmt.Println("------------START DES--------------")
-	kvs = make([]KV, 0)
+	records = make([]Record, 0)
+	txs := makeTxRecovery()
 
 	for {
 		header, err := DeserializeHeader(buf)
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			return nil, errors.New("deserialize fail, " + err.Error())
+			return nil, 0, fmt.Errorf("deserialize fail, %w", err)
 		} else {
-			if header.Info == 0 {
+			var ts uint64
+			stamped := header.Info&RecordStamped != 0
+			if stamped {
+				header.Info &^= RecordStamped
+				if err = binary.Read(buf, binary.BigEndian, &ts); err != nil {
+					return nil, 0, fmt.Errorf("deserialize fail, %w", err)
+				}
+				if ts > maxTS {
+					maxTS = ts
+				}
+			}
+
+			if header.Info > RecordMulti {
+				tx, kv, err := DeserializeTxRecord(buf, header.Info, !stamped, header.CRC)
+				if err == nil && stamped && stampCRC(ts, serializeTxPayload(header.Info, tx, kv)) != header.CRC {
+					err = ErrCRCMismatch
+				}
+				if err != nil {
+					return nil, 0, fmt.Errorf("deserialize fail, %w", err)
+				}
+				records = append(records, stampAll(ts, txs.apply(header.Info, tx, kv))...)
+			} else if header.Info == RecordSingle {
 				//single
 				kv, err := DeserializeSingle(buf, true, header.CRC)
 				if err != nil {
-					return nil, errors.New("deserialize fail, " + err.Error())
+					return nil, 0, fmt.Errorf("deserialize fail, %w", err)
 				}
-				kvs = append(kvs, kv)
+				records = append(records, Record{KV: kv, TS: ts})
 				// fmt.Println("ITEM", header, kv)
 			} else {
 				//multi
-				mkv, err := DeserializeMulti(buf, true, header.CRC)
+				mkv, err := DeserializeMulti(buf, !stamped, header.CRC)
 				// for _, kv := range mkv {
 				// 	fmt.Println("MULT", header, kv)
 				// }
+				if err == nil && stamped && stampCRC(ts, SerializeMulti(mkv)) != header.CRC {
+					err = ErrCRCMismatch
+				}
 				if err != nil {
-					return nil, errors.New("deserialize fail, " + err.Error())
+					return nil, 0, fmt.Errorf("deserialize fail, %w", err)
 				}
-				kvs = append(kvs, mkv...)
+				records = append(records, stampAll(ts, mkv)...)
 			}
 		}
 	}
 	// fmt.Println("------------DES OK--------------")
 
-	return kvs, nil
+	return records, maxTS, nil
 }
 
 type BitcaskStorage struct {
 	index index.Index
+	hist  *history
+	txs   *txRecovery // writes logged by transactions still running
+	path  string
 	file  *os.File
 	lock  sync.Mutex
 }
 
 func OpenBitcask(path string) (store *BitcaskStorage, err error) {
+	return OpenBitcaskWithRetention(path, 0)
+}
+
+// OpenBitcaskWithRetention opens the log keeping the history needed to read
+// at the last retention commit timestamps.
+func OpenBitcaskWithRetention(path string, retention uint64) (store *BitcaskStorage, err error) {
 
 	rfile, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0777)
 	if err != nil {
 		return nil, err
 	}
 
-	kvs, err := Deserialize(rfile)
+	records, ts, err := DeserializeLog(rfile)
 	if err != nil {
 		return nil, err
 	}
@@ -212,21 +285,26 @@ func OpenBitcask(path string) (store *BitcaskStorage, err error) {
 	rfile.Close()
 
 	idx := index.GetNaiveIndex()
+	hist := makeHistory()
+	hist.retention = retention
+	hist.stamp(ts)
 
-	for _, kv := range kvs {
-		v := kv.Value
-		if v == nil {
-			idx.Delete(kv.Key)
+	for _, rec := range records {
+		if rec.Value == nil {
+			idx.Delete(rec.Key)
 		} else {
-			idx.Put(kv.Key, v)
+			idx.Put(rec.Key, rec.Value)
 		}
-
+		hist.put(rec.Key, rec.TS, rec.Value)
 	}
 
 	wfile, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_SYNC, 0777)
 
 	store = &BitcaskStorage{
-		index: idx,   //TODO
+		index: idx, //TODO
+		hist:  hist,
+		txs:   makeTxRecovery(),
+		path:  path,
 		file:  wfile, //TODO multifile
 	}
 
@@ -238,39 +316,103 @@ func (store *BitcaskStorage) Get(key []byte) (value []byte, err error) {
 }
 
 func (store *BitcaskStorage) Put(key []byte, value []byte) (err error) {
-	data := SerializeSingleWithHeader(KV{key, value})
-
-	_, err = store.file.Write(data)
-	if err != nil {
-		return err
-	}
-
-	store.index.Put(key, value)
-	return nil
+	return store.PutBatchAt(0, []KV{{key, value}})
 }
 
 func (store *BitcaskStorage) PutBatch(kvs []KV) (err error) {
 	//TODO compact
-	data := SerializeMultiWithHeader(kvs)
+	return store.PutBatchAt(0, kvs)
+}
 
-	_, err = store.file.Write(data)
+// PutBatchAt is PutBatch for a batch committed at timestamp ts. A batch
+// written without one, at ts 0, is stamped with a fresh timestamp.
+func (store *BitcaskStorage) PutBatchAt(ts uint64, kvs []KV) (err error) {
+	ts = store.hist.fresh(ts)
+	_, err = store.file.Write(SerializeMultiAt(ts, kvs))
 	if err != nil {
 		return err
 	}
+	store.apply(kvs)
+	store.hist.apply(ts, kvs)
+	return nil
+}
 
+func (store *BitcaskStorage) apply(kvs []KV) {
 	for _, kv := range kvs {
-		store.index.Put(kv.Key, kv.Value)
+		if kv.Value == nil {
+			store.index.Delete(kv.Key)
+		} else {
+			store.index.Put(kv.Key, kv.Value)
+		}
 	}
-	return nil
 }
 
-func (store *BitcaskStorage) Delete(key []byte) (err error) {
-	err = store.Put(key, nil)
+// LastTS returns the highest commit timestamp in the log, so timestamps
+// keep increasing across restarts.
+func (store *BitcaskStorage) LastTS() uint64 {
+	return store.hist.last
+}
+
+// GetAt returns the value key had at timestamp ts.
+func (store *BitcaskStorage) GetAt(key []byte, ts uint64) (value []byte, err error) {
+	return store.hist.get(key, ts)
+}
+
+func (store *BitcaskStorage) ScanAt(start []byte, end []byte, ts uint64) (kvs []KV, err error) {
+	return store.hist.scan(start, end, ts)
+}
+
+// SetRetention changes the retention window. Versions already dropped do
+// not come back when it grows; on shrinking, the next merge drops them from
+// the log too.
+func (store *BitcaskStorage) SetRetention(retention uint64) {
+	store.hist.retention = retention
+	store.hist.compact()
+}
+
+// Merge rewrites the log with only what is still needed: the versions
+// inside the retention window and the writes of running transactions.
+func (store *BitcaskStorage) Merge() (err error) {
+	store.hist.compact()
+
+	var buf bytes.Buffer
+	tss, batches := store.hist.records()
+	for _, ts := range tss {
+		buf.Write(SerializeMultiAt(ts, batches[ts]))
+	}
+	if store.hist.last > 0 {
+		// the newest versions may all be gone, the timestamp must stay
+		buf.Write(SerializeMultiAt(store.hist.last, nil))
+	}
+	for tx, writes := range store.txs.pending {
+		buf.Write(SerializeTxRecord(RecordBegin, tx, 0, KV{}))
+		for k, v := range writes {
+			buf.Write(SerializeTxRecord(RecordWrite, tx, 0, KV{[]byte(k), v}))
+		}
+	}
+
+	tmp := store.path + ".merge"
+	err = os.WriteFile(tmp, buf.Bytes(), 0777)
 	if err != nil {
+		os.Remove(tmp)
 		return err
 	}
-	store.index.Delete(key)
-	return nil
+	err = os.Rename(tmp, store.path)
+	if err != nil {
+		return err
+	}
+
+	store.file.Close()
+	store.file, err = os.OpenFile(store.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_SYNC, 0777)
+	return err
+}
+
+func (store *BitcaskStorage) Delete(key []byte) (err error) {
+	return store.Put(key, nil)
+}
+
+func (store *BitcaskStorage) Scan(start []byte, end []byte, limit int) (kvs []KV, err error) {
+	return scanIndex(store.index, start, end, limit), nil
 }
 
 func (store *BitcaskStorage) Close() (err error) {
@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+)
+
+var ErrBeyondRetention = errors.New("timestamp outside the retention window")
+
+// Record is a pair replayed from the log together with the commit timestamp
+// it was written at, 0 for records written without one.
+type Record struct {
+	KV
+	TS uint64
+}
+
+type version struct {
+	TS    uint64
+	Value []byte // nil once the key was deleted
+}
+
+// history keeps the committed versions of every key so they can be read as
+// of a past timestamp. Versions older than the retention window are dropped,
+// except for the newest of them, which is still the value at the horizon.
+// Every version within the window is a full copy of its value held in
+// memory, so a long window over often rewritten keys costs as much.
+type history struct {
+	versions  map[string][]version // ascending by timestamp
+	retention uint64
+	last      uint64
+}
+
+func makeHistory() *history {
+	return &history{
+		versions: make(map[string][]version),
+	}
+}
+
+// horizon is the oldest timestamp that can still be read at.
+func (h *history) horizon() uint64 {
+	if h.last > h.retention {
+		return h.last - h.retention
+	}
+	return 0
+}
+
+func (h *history) stamp(ts uint64) {
+	if ts > h.last {
+		h.last = ts
+	}
+}
+
+// fresh returns ts, or for a write made without a timestamp the one after
+// the latest, so that no version read at an earlier timestamp changes.
+func (h *history) fresh(ts uint64) uint64 {
+	if ts == 0 {
+		return h.last + 1
+	}
+	return ts
+}
+
+// put records value as the version of key at ts, a fresh timestamp for 0.
+func (h *history) put(key []byte, ts uint64, value []byte) {
+	skey := string(key)
+	ts = h.fresh(ts)
+
+	h.stamp(ts)
+	vs := h.versions[skey]
+	i := sort.Search(len(vs), func(i int) bool { return vs[i].TS > ts })
+	if i > 0 && vs[i-1].TS == ts {
+		vs[i-1].Value = value
+	} else {
+		vs = append(vs, version{})
+		copy(vs[i+1:], vs[i:])
+		vs[i] = version{TS: ts, Value: value}
+	}
+	h.versions[skey] = vs
+	h.prune(skey)
+}
+
+func (h *history) apply(ts uint64, kvs []KV) {
+	ts = h.fresh(ts)
+	h.stamp(ts)
+	for _, kv := range kvs {
+		h.put(kv.Key, ts, kv.Value)
+	}
+}
+
+func (h *history) prune(skey string) {
+	vs := h.versions[skey]
+	horizon := h.horizon()
+	i := sort.Search(len(vs), func(i int) bool { return vs[i].TS > horizon })
+	if i > 1 {
+		vs = append([]version{}, vs[i-1:]...)
+	}
+	if len(vs) == 1 && vs[0].Value == nil && vs[0].TS <= horizon {
+		delete(h.versions, skey)
+		return
+	}
+	h.versions[skey] = vs
+}
+
+func (h *history) get(key []byte, ts uint64) ([]byte, error) {
+	if ts < h.horizon() {
+		return nil, ErrBeyondRetention
+	}
+	vs := h.versions[string(key)]
+	i := sort.Search(len(vs), func(i int) bool { return vs[i].TS > ts })
+	if i == 0 {
+		return nil, nil
+	}
+	return vs[i-1].Value, nil
+}
+
+func (h *history) scan(start []byte, end []byte, ts uint64) ([]KV, error) {
+	if ts < h.horizon() {
+		return nil, ErrBeyondRetention
+	}
+	ret := make([]KV, 0)
+	for skey := range h.versions {
+		key := []byte(skey)
+		if bytes.Compare(key, start) < 0 || (end != nil && bytes.Compare(key, end) >= 0) {
+			continue
+		}
+		value, _ := h.get(key, ts)
+		if value != nil {
+			ret = append(ret, KV{Key: key, Value: value})
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return bytes.Compare(ret[i].Key, ret[j].Key) < 0
+	})
+	return ret, nil
+}
+
+// compact prunes every key, for when the window itself got shorter.
+func (h *history) compact() {
+	for skey := range h.versions {
+		h.prune(skey)
+	}
+}
+
+// records returns the retained versions grouped into batches by timestamp,
+// oldest first, ready to be written to a fresh log.
+func (h *history) records() (tss []uint64, batches map[uint64][]KV) {
+	batches = make(map[uint64][]KV)
+	for skey, vs := range h.versions {
+		for _, v := range vs {
+			if _, has := batches[v.TS]; !has {
+				tss = append(tss, v.TS)
+			}
+			batches[v.TS] = append(batches[v.TS], KV{Key: []byte(skey), Value: v.Value})
+		}
+	}
+	sort.Slice(tss, func(i, j int) bool { return tss[i] < tss[j] })
+	return tss, batches
+}
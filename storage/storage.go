@@ -1,6 +1,10 @@
 package storage
 
-import "sync"
+import (
+	"sync"
+
+	"github.com/Al0ha0e/skv/index"
+)
 
 type KV struct {
 	Key   []byte
@@ -12,52 +16,126 @@ type Storage interface {
 	Put(key []byte, value []byte) (err error)
 	PutBatch(kvs []KV) (err error)
 	Delete(key []byte) (err error)
+	LogBegin(tx uint64) (err error)
+	LogWrite(tx uint64, kv KV) (err error)
+	LogUnwrite(tx uint64, key []byte) (err error)
+	LogAbort(tx uint64) (err error)
+	CommitTx(tx uint64, ts uint64, kvs []KV) (err error)
+	PutBatchAt(ts uint64, kvs []KV) (err error)
+	LastTS() uint64
+	GetAt(key []byte, ts uint64) (value []byte, err error)
+	ScanAt(start []byte, end []byte, ts uint64) (kvs []KV, err error)
+	SetRetention(retention uint64)
+	Merge() (err error)
+	Scan(start []byte, end []byte, limit int) (kvs []KV, err error) // the first limit pairs, all of them for 0
 	Close() (err error)
 	Lock()
 	Unlock()
 }
 
 type NaiveStorage struct {
-	store map[string][]byte
+	store *index.NaiveIndex
+	hist  *history
 	lock  sync.Mutex
 }
 
 func MakeNaiveStorage() *NaiveStorage {
 	return &NaiveStorage{
-		store: make(map[string][]byte),
+		store: index.GetNaiveIndex(),
+		hist:  makeHistory(),
 	}
 }
 
 func (ns *NaiveStorage) Get(key []byte) (value []byte, err error) {
-	return ns.store[string(key)], nil
+	return ns.store.Get(key), nil
 }
 
 func (ns *NaiveStorage) Put(key []byte, value []byte) (err error) {
-	ns.store[string(key)] = value
+	ns.store.Put(key, value)
+	ns.hist.put(key, 0, value)
 	return nil
 }
 
 func (ns *NaiveStorage) PutBatch(kvs []KV) (err error) {
+	return ns.PutBatchAt(0, kvs)
+}
+
+func (ns *NaiveStorage) Delete(key []byte) (err error) {
+	ns.store.Delete(key)
+	ns.hist.put(key, 0, nil)
+	return nil
+}
+
+// NaiveStorage keeps nothing across restarts, so it has no log to write.
+func (ns *NaiveStorage) LogBegin(tx uint64) (err error) {
+	return nil
+}
+
+func (ns *NaiveStorage) LogWrite(tx uint64, kv KV) (err error) {
+	return nil
+}
+
+func (ns *NaiveStorage) LogUnwrite(tx uint64, key []byte) (err error) {
+	return nil
+}
+
+func (ns *NaiveStorage) LogAbort(tx uint64) (err error) {
+	return nil
+}
+
+func (ns *NaiveStorage) CommitTx(tx uint64, ts uint64, kvs []KV) (err error) {
+	return ns.PutBatchAt(ts, kvs)
+}
+
+func (ns *NaiveStorage) PutBatchAt(ts uint64, kvs []KV) (err error) {
 	for _, kv := range kvs {
-		k := kv.Key
-		v := kv.Value
-		if v == nil {
-			delete(ns.store, string(k))
+		if kv.Value == nil {
+			ns.store.Delete(kv.Key)
 		} else {
-			ns.store[string(k)] = v
+			ns.store.Put(kv.Key, kv.Value)
 		}
 	}
+	ns.hist.apply(ts, kvs)
 	return nil
 }
 
-func (ns *NaiveStorage) Delete(key []byte) (err error) {
-	_, ok := ns.store[string(key)]
-	if ok {
-		delete(ns.store, string(key))
-	}
+func (ns *NaiveStorage) LastTS() uint64 {
+	return ns.hist.last
+}
+
+func (ns *NaiveStorage) GetAt(key []byte, ts uint64) (value []byte, err error) {
+	return ns.hist.get(key, ts)
+}
+
+func (ns *NaiveStorage) ScanAt(start []byte, end []byte, ts uint64) (kvs []KV, err error) {
+	return ns.hist.scan(start, end, ts)
+}
+
+func (ns *NaiveStorage) SetRetention(retention uint64) {
+	ns.hist.retention = retention
+	ns.hist.compact()
+}
+
+func (ns *NaiveStorage) Merge() (err error) {
+	ns.hist.compact()
 	return nil
 }
 
+func (ns *NaiveStorage) Scan(start []byte, end []byte, limit int) (kvs []KV, err error) {
+	return scanIndex(ns.store, start, end, limit), nil
+}
+
+// scanIndex returns the pairs of idx in [start, end) ordered by key, the
+// first limit of them unless limit is 0.
+func scanIndex(idx index.Index, start []byte, end []byte, limit int) []KV {
+	keys := idx.Keys(start, end, limit)
+	ret := make([]KV, 0, len(keys))
+	for _, key := range keys {
+		ret = append(ret, KV{Key: key, Value: idx.Get(key)})
+	}
+	return ret
+}
+
 func (ns *NaiveStorage) Close() (err error) {
 	return nil
 }
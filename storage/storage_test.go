@@ -136,6 +136,37 @@ func TestBitcask(t *testing.T) {
 	fmt.Println(v)
 }
 
+func TestTombstone(t *testing.T) {
+	os.Remove("../testdata/test.skv")
+	store, err := OpenBitcask("../testdata/test.skv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store.Put([]byte{1}, []byte{})
+	store.Put([]byte{2}, []byte{2})
+	store.Delete([]byte{2})
+	store.PutBatch([]KV{{[]byte{3}, []byte{}}, {[]byte{4}, nil}})
+	store.LogBegin(1)
+	store.LogWrite(1, KV{[]byte{5}, []byte{}})
+	store.CommitTx(1, 1, []KV{{[]byte{5}, []byte{}}})
+	store.Close()
+
+	store, err = OpenBitcask("../testdata/test.skv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	for _, key := range [][]byte{{1}, {3}, {5}} {
+		if v, _ := store.Get(key); v == nil || len(v) != 0 {
+			t.Error("empty value replayed as a deletion", key, v)
+		}
+	}
+	if v, _ := store.Get([]byte{2}); v != nil {
+		t.Error("deleted key came back", v)
+	}
+}
+
 func TestBitcaskLoad(t *testing.T) {
 	os.Remove("../testdata/test.skv")
 	store, err := OpenBitcask("../testdata/test.skv")
@@ -191,3 +222,172 @@ func TestBitcaskLoad(t *testing.T) {
 		fmt.Println(v)
 	}
 }
+
+func TestBitcaskScan(t *testing.T) {
+	os.Remove("../testdata/test.skv")
+	store, err := OpenBitcask("../testdata/test.skv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	store.PutBatch([]KV{
+		{[]byte{1, 1}, []byte{1}},
+		{[]byte{1, 2}, []byte{2}},
+		{[]byte{1, 3}, []byte{3}},
+		{[]byte{2, 1}, []byte{4}},
+	})
+	store.PutBatch([]KV{{[]byte{1, 2}, nil}})
+
+	kvs, _ := store.Scan([]byte{1}, []byte{2}, 0)
+	if len(kvs) != 2 || !bytes.Equal(kvs[0].Key, []byte{1, 1}) || !bytes.Equal(kvs[1].Key, []byte{1, 3}) {
+		t.Fatal("bad scan", kvs)
+	}
+	kvs, _ = store.Scan([]byte{1, 3}, nil, 0)
+	if len(kvs) != 2 || kvs[1].Value[0] != 4 {
+		t.Fatal("bad unbounded scan", kvs)
+	}
+	kvs, _ = store.Scan([]byte{1}, nil, 2)
+	if len(kvs) != 2 || !bytes.Equal(kvs[0].Key, []byte{1, 1}) || !bytes.Equal(kvs[1].Key, []byte{1, 3}) {
+		t.Fatal("bad limited scan", kvs)
+	}
+}
+
+func TestTxRecovery(t *testing.T) {
+	os.Remove("../testdata/test.skv")
+	store, err := OpenBitcask("../testdata/test.skv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store.Put([]byte{1}, []byte{1})
+
+	store.LogBegin(1)
+	store.LogWrite(1, KV{[]byte{1}, []byte{11}})
+	store.LogBegin(2)
+	store.LogWrite(2, KV{[]byte{2}, []byte{22}})
+	store.LogWrite(1, KV{[]byte{3}, []byte{33}})
+	store.LogUnwrite(1, []byte{3})
+	store.LogWrite(1, KV{[]byte{4}, nil})
+	store.LogAbort(2)
+	store.CommitTx(1, 7, []KV{{[]byte{1}, []byte{11}}, {[]byte{4}, nil}})
+	store.PutBatchAt(5, []KV{{[]byte{6}, []byte{66}}})
+
+	store.LogBegin(3)
+	store.LogWrite(3, KV{[]byte{5}, []byte{55}})
+	store.Close()
+
+	store, err = OpenBitcask("../testdata/test.skv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if v, _ := store.Get([]byte{1}); !bytes.Equal(v, []byte{11}) {
+		t.Error("committed write lost", v)
+	}
+	if v, _ := store.Get([]byte{6}); !bytes.Equal(v, []byte{66}) {
+		t.Error("stamped batch lost", v)
+	}
+	if store.LastTS() != 7 {
+		t.Error("commit timestamp not restored", store.LastTS())
+	}
+	for _, key := range [][]byte{{2}, {3}, {4}, {5}} {
+		if v, _ := store.Get(key); v != nil {
+			t.Error("write of unfinished, aborted or undone change recovered", key, v)
+		}
+	}
+}
+
+func TestMergeRetention(t *testing.T) {
+	os.Remove("../testdata/test.skv")
+	store, err := OpenBitcask("../testdata/test.skv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store.SetRetention(10)
+	store.PutBatchAt(1, []KV{{[]byte("a"), []byte{1}}})
+	store.PutBatchAt(2, []KV{{[]byte("a"), []byte{2}}})
+	store.PutBatchAt(3, []KV{{[]byte("b"), []byte{3}}})
+	store.PutBatchAt(4, []KV{{[]byte("a"), nil}})
+
+	if v, _ := store.GetAt([]byte("a"), 1); !bytes.Equal(v, []byte{1}) {
+		t.Error("bad value at 1", v)
+	}
+	if v, _ := store.GetAt([]byte("a"), 3); !bytes.Equal(v, []byte{2}) {
+		t.Error("bad value at 3", v)
+	}
+	if v, _ := store.GetAt([]byte("a"), 4); v != nil {
+		t.Error("deleted key visible", v)
+	}
+
+	store.SetRetention(1)
+	if _, err = store.GetAt([]byte("a"), 2); err != ErrBeyondRetention {
+		t.Error("read before the horizon allowed", err)
+	}
+	store.LogBegin(9)
+	store.LogWrite(9, KV{[]byte("c"), []byte{5}})
+	if err = store.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	store.CommitTx(9, 5, []KV{{[]byte("c"), []byte{5}}})
+	store.Close()
+
+	store, err = OpenBitcaskWithRetention("../testdata/test.skv", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if v, _ := store.GetAt([]byte("a"), 3); !bytes.Equal(v, []byte{2}) {
+		t.Error("version inside the window lost by merge", v)
+	}
+	kvs, _ := store.ScanAt([]byte("a"), nil, 5)
+	if len(kvs) != 2 || string(kvs[0].Key) != "b" || string(kvs[1].Key) != "c" {
+		t.Error("bad scan after merge", kvs)
+	}
+	if store.LastTS() != 5 {
+		t.Error("timestamp lost by merge", store.LastTS())
+	}
+}
+
+func TestUnstampedWrite(t *testing.T) {
+	os.Remove("../testdata/test.skv")
+	store, err := OpenBitcaskWithRetention("../testdata/test.skv", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store.PutBatchAt(1, []KV{{[]byte("a"), []byte{1}}})
+	store.PutBatchAt(2, []KV{{[]byte("b"), []byte{2}}})
+	store.Put([]byte("a"), []byte{3})
+	if v, _ := store.GetAt([]byte("a"), 1); !bytes.Equal(v, []byte{1}) {
+		t.Error("unstamped write dropped the history", v)
+	}
+	if v, _ := store.GetAt([]byte("a"), 2); !bytes.Equal(v, []byte{1}) {
+		t.Error("unstamped write changed the latest timestamp", v)
+	}
+	if v, _ := store.GetAt([]byte("a"), 3); !bytes.Equal(v, []byte{3}) || store.LastTS() != 3 {
+		t.Error("unstamped write not at a fresh timestamp", v, store.LastTS())
+	}
+	if err = store.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	store, err = OpenBitcaskWithRetention("../testdata/test.skv", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if v, _ := store.GetAt([]byte("a"), 2); !bytes.Equal(v, []byte{1}) {
+		t.Error("history lost by merge", v)
+	}
+	if store.LastTS() != 3 {
+		t.Error("fresh timestamp lost by merge", store.LastTS())
+	}
+	if v, _ := store.Get([]byte("a")); !bytes.Equal(v, []byte{3}) {
+		t.Error("bad value", v)
+	}
+}
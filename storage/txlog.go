@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+// Kinds of log records, stored in StorageHeader.Info. Single and multi
+// records are applied as soon as they are read back. The others make up the
+// transaction log: writes of a transaction are logged while it runs and only
+// applied once its commit record is found, so a transaction that aborted or
+// never finished leaves no trace after recovery.
+const (
+	RecordSingle byte = iota
+	RecordMulti
+	RecordBegin
+	RecordWrite
+	RecordUnwrite // takes a key back out of the transaction's writes
+	RecordCommit
+	RecordAbort
+)
+
+// RecordStamped is set in StorageHeader.Info on records whose payload is
+// preceded by the 64-bit commit timestamp they were written at. The
+// checksum covers the timestamp as well.
+const RecordStamped byte = 0x80
+
+func stampCRC(ts uint64, payload []byte) uint32 {
+	var stamp bytes.Buffer
+	binary.Write(&stamp, binary.BigEndian, ts)
+	return crc32.Update(crc32.ChecksumIEEE(stamp.Bytes()), crc32.IEEETable, payload)
+}
+
+func serializeWithHeader(kind byte, ts uint64, payload []byte) []byte {
+	var header StorageHeader
+	header.Timestamp = time.Now().UnixNano()
+	header.Info = kind
+	if ts != 0 {
+		header.CRC = stampCRC(ts, payload)
+		header.Info |= RecordStamped
+	} else {
+		header.CRC = crc32.ChecksumIEEE(payload)
+	}
+
+	var ret bytes.Buffer
+	binary.Write(&ret, binary.BigEndian, &header)
+	if ts != 0 {
+		binary.Write(&ret, binary.BigEndian, ts)
+	}
+	ret.Write(payload)
+	return ret.Bytes()
+}
+
+// SerializeMultiAt is SerializeMultiWithHeader for a batch committed at ts.
+func SerializeMultiAt(ts uint64, kvs []KV) []byte {
+	return serializeWithHeader(RecordMulti, ts, SerializeMulti(kvs))
+}
+
+func serializeTxPayload(kind byte, tx uint64, kv KV) []byte {
+	var payload bytes.Buffer
+	binary.Write(&payload, binary.BigEndian, tx)
+	if kind == RecordWrite || kind == RecordUnwrite {
+		payload.Write(SerializeSingle(kv))
+	}
+	return payload.Bytes()
+}
+
+// SerializeTxRecord serializes a transaction record. Only commit records
+// carry a timestamp, the others are written with ts 0.
+func SerializeTxRecord(kind byte, tx uint64, ts uint64, kv KV) []byte {
+	return serializeWithHeader(kind, ts, serializeTxPayload(kind, tx, kv))
+}
+
+func DeserializeTxRecord(buf io.Reader, kind byte, check bool, crc uint32) (tx uint64, kv KV, err error) {
+	err = binary.Read(buf, binary.BigEndian, &tx)
+	if err != nil {
+		return tx, kv, err
+	}
+	if kind == RecordWrite || kind == RecordUnwrite {
+		kv, err = DeserializeSingle(buf, false, 0)
+		if err != nil {
+			return tx, kv, err
+		}
+	}
+
+	if check && crc32.ChecksumIEEE(serializeTxPayload(kind, tx, kv)) != crc {
+		return tx, kv, ErrCRCMismatch
+	}
+	return tx, kv, nil
+}
+
+// txRecovery collects the writes of the transactions found in the log until
+// their outcome is known.
+type txRecovery struct {
+	pending map[uint64]map[string][]byte
+}
+
+func makeTxRecovery() *txRecovery {
+	return &txRecovery{
+		pending: make(map[uint64]map[string][]byte),
+	}
+}
+
+// apply handles one transaction record, returning the writes to replay if
+// it commits a transaction.
+func (rec *txRecovery) apply(kind byte, tx uint64, kv KV) []KV {
+	switch kind {
+	case RecordBegin:
+		// ids are reused after a restart, a new begin starts afresh
+		rec.pending[tx] = make(map[string][]byte)
+	case RecordWrite:
+		if writes, has := rec.pending[tx]; has {
+			writes[string(kv.Key)] = kv.Value
+		}
+	case RecordUnwrite:
+		if writes, has := rec.pending[tx]; has {
+			delete(writes, string(kv.Key))
+		}
+	case RecordCommit:
+		writes := rec.pending[tx]
+		delete(rec.pending, tx)
+		ret := make([]KV, 0, len(writes))
+		for k, v := range writes {
+			ret = append(ret, KV{Key: []byte(k), Value: v})
+		}
+		return ret
+	case RecordAbort:
+		delete(rec.pending, tx)
+	}
+	return nil
+}
+
+func (store *BitcaskStorage) logTx(kind byte, tx uint64, kv KV) (err error) {
+	_, err = store.file.Write(SerializeTxRecord(kind, tx, 0, kv))
+	if err != nil {
+		return err
+	}
+	store.txs.apply(kind, tx, kv)
+	return nil
+}
+
+func (store *BitcaskStorage) LogBegin(tx uint64) (err error) {
+	return store.logTx(RecordBegin, tx, KV{})
+}
+
+func (store *BitcaskStorage) LogWrite(tx uint64, kv KV) (err error) {
+	return store.logTx(RecordWrite, tx, kv)
+}
+
+func (store *BitcaskStorage) LogUnwrite(tx uint64, key []byte) (err error) {
+	return store.logTx(RecordUnwrite, tx, KV{Key: key})
+}
+
+func (store *BitcaskStorage) LogAbort(tx uint64) (err error) {
+	return store.logTx(RecordAbort, tx, KV{})
+}
+
+// CommitTx logs the commit record of tx, stamped with its commit timestamp
+// ts or a fresh one for 0, and then applies kvs, which must be the writes
+// tx has logged.
+func (store *BitcaskStorage) CommitTx(tx uint64, ts uint64, kvs []KV) (err error) {
+	ts = store.hist.fresh(ts)
+	_, err = store.file.Write(SerializeTxRecord(RecordCommit, tx, ts, KV{}))
+	if err != nil {
+		return err
+	}
+	store.txs.apply(RecordCommit, tx, KV{})
+	store.apply(kvs)
+	store.hist.apply(ts, kvs)
+	return nil
+}
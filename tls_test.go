@@ -0,0 +1,171 @@
+package skv
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert issues a certificate for name, signed by parent with parentKey or
+// self-signed when parent is nil, and writes it and its key in dir as
+// name.pem and name.key.
+func writeCert(t *testing.T, dir, name string, ca bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if ca {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err = ioutil.WriteFile(filepath.Join(dir, name+".pem"), certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// writeCerts writes a CA, a server and a client certificate signed by it,
+// and a client certificate signed by another CA, in a temporary directory.
+func writeCerts(t *testing.T) string {
+	dir := t.TempDir()
+	ca, caKey := writeCert(t, dir, "ca", true, nil, nil)
+	writeCert(t, dir, "server", false, ca, caKey)
+	writeCert(t, dir, "client", false, ca, caKey)
+	other, otherKey := writeCert(t, dir, "other", true, nil, nil)
+	writeCert(t, dir, "stranger", false, other, otherKey)
+	return dir
+}
+
+func tlsClient(t *testing.T, dir, url, cert string) *TesterClient {
+	var config *tls.Config
+	var err error
+	if cert == "" {
+		config, err = ClientTLSConfig(filepath.Join(dir, "ca.pem"), "", "")
+	} else {
+		config, err = ClientTLSConfig(filepath.Join(dir, "ca.pem"),
+			filepath.Join(dir, cert+".pem"), filepath.Join(dir, cert+".key"))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := MakeTestClient(url)
+	client.TLSConfig = config
+	return client
+}
+
+func TestTLS(t *testing.T) {
+	dir := writeCerts(t)
+	server := makeTestServer(t, "./testdata/tls.skv", "127.0.0.1:20016")
+	config, err := ServerTLSConfig(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.TLSConfig = config
+	startTestServer(t, server, "127.0.0.1:20016")
+	defer server.Stop()
+
+	client := tlsClient(t, dir, "127.0.0.1:20016", "")
+	if err := client.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Stop()
+	client.Operate(OPPUT, "A", 1)
+	if res := client.Operate(OPGET, "A", 0); res.Value != 1 {
+		t.Fatal("bad value", res)
+	}
+
+	// the server certificate is not signed by a CA the client trusts
+	untrusted := MakeTestClient("127.0.0.1:20016")
+	untrusted.TLSConfig = &tls.Config{}
+	if err := untrusted.Run(); err == nil {
+		untrusted.Stop()
+		t.Fatal("untrusted server certificate accepted")
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := writeCerts(t)
+	server := makeTestServer(t, "./testdata/mtls.skv", "127.0.0.1:20017")
+	config, err := ServerTLSConfig(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key"),
+		filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.TLSConfig = config
+	startTestServer(t, server, "127.0.0.1:20017")
+	defer server.Stop()
+
+	client := tlsClient(t, dir, "127.0.0.1:20017", "client")
+	if err := client.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Stop()
+	if res := client.Operate(OPPUT, "A", 1); res.State&2 == 0 {
+		t.Fatal("client with a trusted certificate refused", res)
+	}
+
+	for _, cert := range []string{"", "stranger"} {
+		client := tlsClient(t, dir, "127.0.0.1:20017", cert)
+		// with TLS 1.3 the server checks the client certificate once the
+		// client is done with the handshake, the request is what fails
+		if err := client.Run(); err != nil {
+			continue
+		}
+		res := client.Operate(OPGET, "A", 0)
+		client.Stop()
+		if res.State&2 != 0 {
+			t.Fatal("client certificate not checked", cert, res)
+		}
+	}
+}
+
+func TestTLSConfigErrors(t *testing.T) {
+	dir := writeCerts(t)
+	if _, err := ServerTLSConfig(filepath.Join(dir, "server.pem"), filepath.Join(dir, "client.key"), ""); err == nil {
+		t.Fatal("mismatched key accepted")
+	}
+	if _, err := ClientTLSConfig(filepath.Join(dir, "server.key"), "", ""); err != ErrNoCertificates {
+		t.Fatal("CA file without certificates accepted", err)
+	}
+}
@@ -0,0 +1,49 @@
+package transaction
+
+// findCycle walks the waits-for graph from start and returns the transactions
+// on a cycle leading back to it, or nil if start is not deadlocked. The graph
+// is acyclic before start begins waiting, so any new cycle passes through it.
+func (lm *LockManager) findCycle(start TxID) []TxID {
+	path := []TxID{start}
+	visited := map[TxID]bool{start: true}
+
+	var dfs func(id TxID) bool
+	dfs = func(id TxID) bool {
+		req, has := lm.waiting[id]
+		if !has {
+			return false
+		}
+		for _, blocker := range lm.blockers(req) {
+			if blocker == start {
+				return true
+			}
+			if visited[blocker] {
+				continue
+			}
+			visited[blocker] = true
+			path = append(path, blocker)
+			if dfs(blocker) {
+				return true
+			}
+			path = path[:len(path)-1]
+		}
+		return false
+	}
+
+	if dfs(start) {
+		return path
+	}
+	return nil
+}
+
+// youngest picks the transaction of cycle with the latest start timestamp,
+// so that a restarted transaction keeps the age it had.
+func (lm *LockManager) youngest(cycle []TxID) TxID {
+	ret := cycle[0]
+	for _, id := range cycle {
+		if ts := lm.ts(id); ts > lm.ts(ret) || (ts == lm.ts(ret) && id > ret) {
+			ret = id
+		}
+	}
+	return ret
+}
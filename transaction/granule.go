@@ -0,0 +1,323 @@
+package transaction
+
+import (
+	"context"
+	"strings"
+)
+
+// LockMode is the mode a prefix of the key space is locked in. Keys are
+// grouped into a hierarchy by LockManager.Separator: with "/" the key
+// "tenant/users/42" lives under the prefixes "tenant/" and "tenant/users/".
+type LockMode = int
+
+const (
+	LockModeNone LockMode = iota
+	LockModeIS            // intends to read keys below the prefix
+	LockModeIX            // intends to write keys below the prefix
+	LockModeS             // reads the whole prefix
+	LockModeSIX           // reads the whole prefix and writes some keys below it
+	LockModeX             // reads and writes the whole prefix
+)
+
+var modeCompatible = [][]bool{
+	LockModeNone: {true, true, true, true, true, true},
+	LockModeIS:   {true, true, true, true, true, false},
+	LockModeIX:   {true, true, true, false, false, false},
+	LockModeS:    {true, true, false, true, false, false},
+	LockModeSIX:  {true, true, false, false, false, false},
+	LockModeX:    {true, false, false, false, false, false},
+}
+
+// combineModes returns the weakest mode granting everything a and b do.
+func combineModes(a LockMode, b LockMode) LockMode {
+	if a < b {
+		a, b = b, a
+	}
+	if a == LockModeS && b == LockModeIX {
+		return LockModeSIX
+	}
+	return a
+}
+
+func intentionMode(mode LockMode) LockMode {
+	if mode == LockModeIS || mode == LockModeS {
+		return LockModeIS
+	}
+	return LockModeIX
+}
+
+type PrefixLock struct {
+	Holders map[TxID]LockMode
+	Queue   []*LockRequest
+}
+
+func MakePrefixLock() *PrefixLock {
+	return &PrefixLock{
+		Holders: make(map[TxID]LockMode),
+		Queue:   make([]*LockRequest, 0),
+	}
+}
+
+func (p *PrefixLock) grantable(id TxID, mode LockMode) bool {
+	for holder, held := range p.Holders {
+		if holder != id && !modeCompatible[held][mode] {
+			return false
+		}
+	}
+	return true
+}
+
+// prefixRange is the range of keys living under prefix.
+func prefixRange(prefix string) *RangeLock {
+	return &RangeLock{Start: prefix, End: string(PrefixEnd([]byte(prefix)))}
+}
+
+// rangeConflicts tells whether holding a prefix in mode excludes a range
+// lock overlapping it. Intention modes never do, the key locks taken below
+// them meet the range lock instead.
+func rangeConflicts(mode LockMode, shared bool) bool {
+	return mode == LockModeX || (!shared && mode >= LockModeS)
+}
+
+// prefixGrantable tells whether id may hold prefix in mode, given both the
+// other holders of the prefix and the range locks overlapping it.
+func (lm *LockManager) prefixGrantable(prefix string, p *PrefixLock, id TxID, mode LockMode) bool {
+	return p.grantable(id, mode) && len(lm.prefixRangeHolders(id, prefix, mode)) == 0
+}
+
+func (lm *LockManager) prefixRangeHolders(id TxID, prefix string, mode LockMode) []TxID {
+	ret := make([]TxID, 0)
+	span := prefixRange(prefix)
+	for _, r := range lm.Ranges {
+		if r.TxID != id && r.overlaps(span.Start, span.End) && rangeConflicts(mode, r.Shared) {
+			ret = append(ret, r.TxID)
+		}
+	}
+	return ret
+}
+
+func MakePrefixRequest(id TxID, prefix string, mode LockMode) *LockRequest {
+	req := MakeLockRequest(id, prefix, mode == LockModeIS || mode == LockModeS)
+	req.Mode = mode
+	req.Prefix = true
+	return req
+}
+
+// ancestors returns the prefixes s lives under, outermost first.
+func (lm *LockManager) ancestors(s string) []string {
+	ret := make([]string, 0)
+	if lm.Separator == "" {
+		return ret
+	}
+	for i := 0; ; {
+		j := strings.Index(s[i:], lm.Separator)
+		if j < 0 {
+			break
+		}
+		i += j + len(lm.Separator)
+		if i >= len(s) {
+			break
+		}
+		ret = append(ret, s[:i])
+	}
+	return ret
+}
+
+// LockPrefix locks every key under prefix at once. Intention locks are taken
+// on the enclosing prefixes first, and a mode already held is converted to
+// the combination of both.
+func (lm *LockManager) LockPrefix(ctx context.Context, id TxID, prefix string, mode LockMode) error {
+	intent := intentionMode(mode)
+	for _, ancestor := range lm.ancestors(prefix) {
+		if err := lm.lockPrefix(ctx, id, ancestor, intent); err != nil {
+			return err
+		}
+	}
+	return lm.lockPrefix(ctx, id, prefix, mode)
+}
+
+func (lm *LockManager) lockPrefix(ctx context.Context, id TxID, prefix string, mode LockMode) error {
+	lm.latch.Lock()
+
+	if owner, has := lm.owners[id]; has && owner.wounded {
+		lm.latch.Unlock()
+		return ErrWounded
+	}
+
+	p, has := lm.Prefixes[prefix]
+	if !has {
+		p = MakePrefixLock()
+		lm.Prefixes[prefix] = p
+	}
+
+	held, holds := p.Holders[id]
+	want := combineModes(held, mode)
+	if want == held {
+		lm.latch.Unlock()
+		return nil
+	}
+	// conversions go ahead of the queue just like key upgrades
+	if (holds || len(p.Queue) == 0) && lm.prefixGrantable(prefix, p, id, want) {
+		p.Holders[id] = want
+		lm.latch.Unlock()
+		return nil
+	}
+
+	req := MakePrefixRequest(id, prefix, want)
+	req.Upgrade = holds
+	return lm.block(ctx, req)
+}
+
+// lockHierarchy locks key after taking intention locks on its prefixes. No
+// key lock is needed when a prefix is already held in a mode covering it.
+func (lm *LockManager) lockHierarchy(ctx context.Context, id TxID, key string, shared bool) error {
+	ancestors := lm.ancestors(key)
+
+	lm.latch.Lock()
+	if lm.covered(id, ancestors, shared) {
+		lm.latch.Unlock()
+		return nil
+	}
+	info, has := lm.Locks[key]
+	fresh := !has || !info.Holders[id]
+	lm.latch.Unlock()
+
+	intent := LockModeIX
+	if shared {
+		intent = LockModeIS
+	}
+	for _, ancestor := range ancestors {
+		if err := lm.lockPrefix(ctx, id, ancestor, intent); err != nil {
+			return err
+		}
+	}
+
+	if err := lm.lockKey(ctx, id, key, shared); err != nil {
+		return err
+	}
+	if !fresh || len(ancestors) == 0 {
+		return nil
+	}
+
+	lm.latch.Lock()
+	defer lm.latch.Unlock()
+	parent := ancestors[len(ancestors)-1]
+	counts, has := lm.fine[id]
+	if !has {
+		counts = make(map[string]int)
+		lm.fine[id] = counts
+	}
+	counts[parent]++
+	if lm.EscalateAfter > 0 && counts[parent] > lm.EscalateAfter {
+		lm.escalate(id, parent)
+	}
+	return nil
+}
+
+func (lm *LockManager) covered(id TxID, ancestors []string, shared bool) bool {
+	for _, ancestor := range ancestors {
+		p, has := lm.Prefixes[ancestor]
+		if !has {
+			continue
+		}
+		held := p.Holders[id]
+		if held == LockModeX || (shared && (held == LockModeS || held == LockModeSIX)) {
+			return true
+		}
+	}
+	return false
+}
+
+// escalate replaces the key locks id holds under prefix with a single S or X
+// lock on the prefix. It is best effort: if another transaction is using
+// the prefix the fine-grained locks are simply kept.
+func (lm *LockManager) escalate(id TxID, prefix string) {
+	mode := LockModeS
+	keys := make([]string, 0)
+	for key, info := range lm.Locks {
+		if info.Holders[id] && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+			if !info.Shared {
+				mode = LockModeX
+			}
+		}
+	}
+
+	p := lm.Prefixes[prefix]
+	want := combineModes(p.Holders[id], mode)
+	if !lm.prefixGrantable(prefix, p, id, want) {
+		return
+	}
+	p.Holders[id] = want
+
+	for _, key := range keys {
+		lm.unlock(id, key)
+	}
+	for sub := range lm.fine[id] {
+		if strings.HasPrefix(sub, prefix) {
+			delete(lm.fine[id], sub)
+		}
+	}
+	lm.grantRanges()
+}
+
+// forget drops key from the fine-grained lock count of id.
+func (lm *LockManager) forget(id TxID, key string) {
+	ancestors := lm.ancestors(key)
+	if len(ancestors) == 0 {
+		return
+	}
+	parent := ancestors[len(ancestors)-1]
+	if counts, has := lm.fine[id]; has && counts[parent] > 0 {
+		counts[parent]--
+	}
+}
+
+// unlockPrefixes releases every prefix lock held by id.
+func (lm *LockManager) unlockPrefixes(id TxID) {
+	delete(lm.fine, id)
+	released := false
+	for prefix, p := range lm.Prefixes {
+		if _, has := p.Holders[id]; has {
+			delete(p.Holders, id)
+			lm.grantPrefix(prefix, p)
+			released = true
+		}
+	}
+	if released {
+		lm.grantRanges()
+	}
+}
+
+func (lm *LockManager) grantPrefix(prefix string, p *PrefixLock) {
+	for len(p.Queue) > 0 {
+		req := p.Queue[0]
+		if !lm.prefixGrantable(prefix, p, req.TxID, req.Mode) {
+			break
+		}
+		p.Queue = p.Queue[1:]
+		p.Holders[req.TxID] = req.Mode
+		delete(lm.waiting, req.TxID)
+		close(req.done)
+	}
+	if len(p.Holders) == 0 && len(p.Queue) == 0 {
+		delete(lm.Prefixes, prefix)
+	}
+}
+
+func (lm *LockManager) prefixBlockers(req *LockRequest) []TxID {
+	p := lm.Prefixes[req.Key]
+	ret := lm.prefixRangeHolders(req.TxID, req.Key, req.Mode)
+	for holder, held := range p.Holders {
+		if holder != req.TxID && !modeCompatible[held][req.Mode] {
+			ret = append(ret, holder)
+		}
+	}
+	for _, r := range p.Queue {
+		if r == req {
+			break
+		}
+		ret = append(ret, r.TxID)
+	}
+	return ret
+}
@@ -0,0 +1,72 @@
+package transaction
+
+import (
+	"sync"
+
+	"github.com/Al0ha0e/skv/storage"
+)
+
+// PreCommitHook runs just before a transaction commits, with the writes it is
+// about to make. It may add writes of its own through tx, and vetoes the
+// commit, aborting the transaction, by returning an error.
+type PreCommitHook = func(tx Transaction, writes []storage.KV) error
+
+// PostCommitHook runs once a transaction has committed, with the keys it
+// wrote, after its locks are released.
+type PostCommitHook = func(keys [][]byte)
+
+// Hooks holds the commit hooks registered on a database or on a single
+// transaction. Hooks run in the order they were registered.
+type Hooks struct {
+	pre   []PreCommitHook
+	post  []PostCommitHook
+	latch sync.Mutex
+}
+
+func (h *Hooks) OnPreCommit(fn PreCommitHook) {
+	h.latch.Lock()
+	h.pre = append(h.pre, fn)
+	h.latch.Unlock()
+}
+
+func (h *Hooks) OnPostCommit(fn PostCommitHook) {
+	h.latch.Lock()
+	h.post = append(h.post, fn)
+	h.latch.Unlock()
+}
+
+func (h *Hooks) preCommit(tx Transaction, writes []storage.KV) error {
+	if h == nil {
+		return nil
+	}
+	h.latch.Lock()
+	pre := append([]PreCommitHook{}, h.pre...)
+	h.latch.Unlock()
+
+	for _, fn := range pre {
+		if err := fn(tx, writes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *Hooks) postCommit(writes []storage.KV) {
+	if h == nil {
+		return
+	}
+	h.latch.Lock()
+	post := append([]PostCommitHook{}, h.post...)
+	h.latch.Unlock()
+	if len(post) == 0 {
+		return
+	}
+
+	keys := make([][]byte, 0, len(writes))
+	for _, kv := range writes {
+		keys = append(keys, kv.Key)
+	}
+	for _, fn := range post {
+		fn(keys)
+	}
+}
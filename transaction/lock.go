@@ -0,0 +1,573 @@
+package transaction
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+type TxID = uint64
+
+type LockPolicy = int
+
+const (
+	LockPolicyNoWait LockPolicy = iota
+	LockPolicyDetect
+	LockPolicyWaitDie
+	LockPolicyWoundWait
+)
+
+type LockRequest struct {
+	TxID    TxID
+	Key     string
+	End     string   // only for range requests, which cover [Key, End)
+	Mode    LockMode // only for prefix requests
+	Shared  bool
+	Upgrade bool
+	Range   bool
+	Prefix  bool
+	err     error
+	done    chan struct{}
+}
+
+func MakeLockRequest(id TxID, key string, shared bool) *LockRequest {
+	return &LockRequest{
+		TxID:   id,
+		Key:    key,
+		Shared: shared,
+		done:   make(chan struct{}),
+	}
+}
+
+type LockInfo struct {
+	Shared  bool
+	Cnt     int
+	Holders map[TxID]bool
+	Queue   []*LockRequest
+}
+
+func MakeLockInfo(shared bool) *LockInfo {
+	return &LockInfo{
+		Shared:  shared,
+		Cnt:     0,
+		Holders: make(map[TxID]bool),
+		Queue:   make([]*LockRequest, 0),
+	}
+}
+
+func (info *LockInfo) compatible(shared bool) bool {
+	return info.Cnt == 0 || (shared && info.Shared)
+}
+
+func (info *LockInfo) grantable(req *LockRequest) bool {
+	if req.Upgrade {
+		// only the upgrading transaction itself may still hold the lock
+		return info.Cnt == 1
+	}
+	return info.compatible(req.Shared)
+}
+
+func (info *LockInfo) grant(id TxID, shared bool) {
+	if info.Cnt == 0 {
+		info.Shared = shared
+	}
+	info.Holders[id] = true
+	info.Cnt += 1
+}
+
+// enqueueRequest appends req to the queue, except that upgrades go ahead of
+// every ordinary request so a reader converting to a writer is served first.
+func enqueueRequest(queue []*LockRequest, req *LockRequest) []*LockRequest {
+	pos := len(queue)
+	if req.Upgrade {
+		pos = 0
+		for pos < len(queue) && queue[pos].Upgrade {
+			pos++
+		}
+	}
+	queue = append(queue, nil)
+	copy(queue[pos+1:], queue[pos:])
+	queue[pos] = req
+	return queue
+}
+
+func dequeueRequest(queue []*LockRequest, req *LockRequest) []*LockRequest {
+	for i, r := range queue {
+		if r == req {
+			return append(queue[:i], queue[i+1:]...)
+		}
+	}
+	return queue
+}
+
+type lockOwner struct {
+	TS         uint64
+	wounded    bool
+	committing bool // sealed, see seal
+}
+
+type LockManager struct {
+	Locks         map[string]*LockInfo
+	keys          []string // the keys of Locks in order, see keysIn
+	Policy        LockPolicy
+	LockTimeout   time.Duration
+	TxTimeout     time.Duration
+	Versions      *MVCCLockManager // optional, keeps snapshots consistent with commits
+	Hooks         *Hooks           // optional, run on every commit
+	Ranges        []*RangeLock
+	Prefixes      map[string]*PrefixLock
+	Separator     string // splits keys into prefixes, empty disables prefix locking
+	EscalateAfter int    // key locks under one prefix before escalating, 0 never does
+	NextID        TxID
+	owners        map[TxID]*lockOwner
+	waiting       map[TxID]*LockRequest
+	rangeQueue    []*LockRequest
+	fine          map[TxID]map[string]int // key locks held under each prefix
+	latch         sync.Mutex
+}
+
+func MakeLockManager(policy LockPolicy) *LockManager {
+	return &LockManager{
+		Locks:      make(map[string]*LockInfo),
+		keys:       make([]string, 0),
+		Policy:     policy,
+		Ranges:     make([]*RangeLock, 0),
+		Prefixes:   make(map[string]*PrefixLock),
+		NextID:     0,
+		owners:     make(map[TxID]*lockOwner),
+		waiting:    make(map[TxID]*LockRequest),
+		rangeQueue: make([]*LockRequest, 0),
+		fine:       make(map[TxID]map[string]int),
+	}
+}
+
+// Begin registers a new transaction whose start timestamp is its id.
+func (lm *LockManager) Begin() TxID {
+	lm.latch.Lock()
+	defer lm.latch.Unlock()
+	lm.NextID++
+	lm.owners[lm.NextID] = &lockOwner{TS: lm.NextID}
+	return lm.NextID
+}
+
+// BeginAt registers a new transaction that keeps an earlier start timestamp,
+// so a restarted transaction does not lose its age under wait-die or
+// wound-wait.
+func (lm *LockManager) BeginAt(ts uint64) TxID {
+	lm.latch.Lock()
+	defer lm.latch.Unlock()
+	lm.NextID++
+	lm.owners[lm.NextID] = &lockOwner{TS: ts}
+	return lm.NextID
+}
+
+// End forgets id and releases the prefix locks it still holds.
+func (lm *LockManager) End(id TxID) {
+	lm.latch.Lock()
+	delete(lm.owners, id)
+	lm.unlockPrefixes(id)
+	lm.latch.Unlock()
+}
+
+func (lm *LockManager) TS(id TxID) uint64 {
+	lm.latch.Lock()
+	defer lm.latch.Unlock()
+	return lm.ts(id)
+}
+
+func (lm *LockManager) Wounded(id TxID) bool {
+	lm.latch.Lock()
+	defer lm.latch.Unlock()
+	owner, has := lm.owners[id]
+	return has && owner.wounded
+}
+
+func (lm *LockManager) ts(id TxID) uint64 {
+	owner, has := lm.owners[id]
+	if has {
+		return owner.TS
+	}
+	return id
+}
+
+func (lm *LockManager) GetLockInfo(key string) *LockInfo {
+	lm.latch.Lock()
+	defer lm.latch.Unlock()
+	return lm.Locks[key]
+}
+
+func (lm *LockManager) Lock(ctx context.Context, id TxID, key string, shared bool) error {
+	if lm.Separator != "" {
+		return lm.lockHierarchy(ctx, id, key, shared)
+	}
+	return lm.lockKey(ctx, id, key, shared)
+}
+
+func (lm *LockManager) lockKey(ctx context.Context, id TxID, key string, shared bool) error {
+	lm.latch.Lock()
+
+	if owner, has := lm.owners[id]; has && owner.wounded {
+		lm.latch.Unlock()
+		return ErrWounded
+	}
+
+	info, has := lm.Locks[key]
+	if !has {
+		info = MakeLockInfo(shared)
+		lm.addLock(key, info)
+	}
+
+	if info.Holders[id] {
+		if shared || !info.Shared {
+			lm.latch.Unlock()
+			return nil
+		}
+		return lm.upgrade(ctx, id, key, info)
+	}
+
+	// requests never overtake the queue, otherwise a steady stream of
+	// readers would starve a waiting writer, nor a range request waiting
+	// for the keys around it
+	if len(info.Queue) == 0 && info.compatible(shared) && !lm.rangeConflict(id, key, shared) &&
+		len(lm.queuedRanges(id, key, shared)) == 0 {
+		info.grant(id, shared)
+		lm.latch.Unlock()
+		return nil
+	}
+
+	return lm.block(ctx, MakeLockRequest(id, key, shared))
+}
+
+// block queues req according to the lock policy and waits for it to be
+// resolved. It must be called with the latch held and releases it.
+func (lm *LockManager) block(ctx context.Context, req *LockRequest) error {
+	id := req.TxID
+	lm.enqueue(req)
+
+	switch lm.Policy {
+	case LockPolicyNoWait:
+		lm.withdraw(req)
+		lm.latch.Unlock()
+		return ErrLockConflict
+	case LockPolicyWaitDie:
+		if !lm.olderThan(id, lm.blockers(req)) {
+			lm.withdraw(req)
+			lm.latch.Unlock()
+			return ErrDie
+		}
+	}
+
+	lm.waiting[id] = req
+	switch lm.Policy {
+	case LockPolicyWoundWait:
+		lm.wound(id, lm.blockers(req))
+	case LockPolicyDetect:
+		if cycle := lm.findCycle(id); cycle != nil {
+			lm.cancel(lm.waiting[lm.youngest(cycle)], ErrDeadlock)
+		}
+	}
+	lm.latch.Unlock()
+
+	return lm.wait(ctx, req)
+}
+
+func (lm *LockManager) enqueue(req *LockRequest) {
+	switch {
+	case req.Range:
+		lm.rangeQueue = append(lm.rangeQueue, req)
+	case req.Prefix:
+		p := lm.Prefixes[req.Key]
+		p.Queue = enqueueRequest(p.Queue, req)
+	default:
+		info := lm.Locks[req.Key]
+		info.Queue = enqueueRequest(info.Queue, req)
+	}
+}
+
+func (lm *LockManager) dequeue(req *LockRequest) {
+	switch {
+	case req.Range:
+		lm.rangeQueue = dequeueRequest(lm.rangeQueue, req)
+	case req.Prefix:
+		p := lm.Prefixes[req.Key]
+		p.Queue = dequeueRequest(p.Queue, req)
+	default:
+		info := lm.Locks[req.Key]
+		info.Queue = dequeueRequest(info.Queue, req)
+	}
+}
+
+// blockers returns the transactions req has to wait for: incompatible
+// holders of the key or of a covering range, and every request queued ahead
+// of it on the key.
+func (lm *LockManager) blockers(req *LockRequest) []TxID {
+	if req.Range {
+		return lm.rangeBlockers(req)
+	}
+	if req.Prefix {
+		return lm.prefixBlockers(req)
+	}
+
+	info := lm.Locks[req.Key]
+	ret := lm.rangeHolders(req.TxID, req.Key, req.Shared)
+	if !req.Upgrade {
+		ret = append(ret, lm.queuedRanges(req.TxID, req.Key, req.Shared)...)
+	}
+	if req.Upgrade || !info.compatible(req.Shared) {
+		for holder := range info.Holders {
+			if holder != req.TxID {
+				ret = append(ret, holder)
+			}
+		}
+	}
+	for _, r := range info.Queue {
+		if r == req {
+			break
+		}
+		ret = append(ret, r.TxID)
+	}
+	return ret
+}
+
+func (lm *LockManager) wait(ctx context.Context, req *LockRequest) error {
+	var timeout <-chan time.Time
+	if lm.LockTimeout > 0 {
+		timer := time.NewTimer(lm.LockTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-req.done:
+		return req.err
+	case <-ctx.Done():
+		return lm.giveUp(req, ctx.Err())
+	case <-timeout:
+		return lm.giveUp(req, ErrLockTimeout)
+	}
+}
+
+// giveUp withdraws a request that stopped waiting. If the request was
+// resolved concurrently, that outcome wins so a granted lock is not leaked.
+func (lm *LockManager) giveUp(req *LockRequest, err error) error {
+	lm.latch.Lock()
+	defer lm.latch.Unlock()
+
+	select {
+	case <-req.done:
+		return req.err
+	default:
+	}
+	lm.cancel(req, err)
+	return err
+}
+
+func (lm *LockManager) Unlock(id TxID, key string) {
+	lm.latch.Lock()
+	defer lm.latch.Unlock()
+
+	if lm.unlock(id, key) {
+		lm.grantRanges()
+	}
+}
+
+func (lm *LockManager) unlock(id TxID, key string) bool {
+	info, has := lm.Locks[key]
+	if !has || !info.Holders[id] {
+		return false
+	}
+	delete(info.Holders, id)
+	info.Cnt -= 1
+	lm.forget(id, key)
+	lm.grantWaiting(key, info)
+	return true
+}
+
+func (lm *LockManager) Upgrade(ctx context.Context, id TxID, key string) error {
+	if lm.Separator != "" {
+		// the shared lock may have been escalated away, and writing also
+		// needs intention locks on the prefixes
+		return lm.lockHierarchy(ctx, id, key, false)
+	}
+
+	lm.latch.Lock()
+
+	if owner, has := lm.owners[id]; has && owner.wounded {
+		lm.latch.Unlock()
+		return ErrWounded
+	}
+
+	info, has := lm.Locks[key]
+	if !has || !info.Holders[id] {
+		lm.latch.Unlock()
+		return ErrLockConflict
+	}
+	if !info.Shared {
+		lm.latch.Unlock()
+		return nil
+	}
+	return lm.upgrade(ctx, id, key, info)
+}
+
+func (lm *LockManager) upgrade(ctx context.Context, id TxID, key string, info *LockInfo) error {
+	if info.Cnt == 1 && !lm.rangeConflict(id, key, false) {
+		info.Shared = false
+		lm.latch.Unlock()
+		return nil
+	}
+
+	req := MakeLockRequest(id, key, false)
+	req.Upgrade = true
+	return lm.block(ctx, req)
+}
+
+func (lm *LockManager) olderThan(id TxID, others []TxID) bool {
+	ts := lm.ts(id)
+	for _, other := range others {
+		if lm.ts(other) <= ts {
+			return false
+		}
+	}
+	return true
+}
+
+// wound aborts every transaction in others younger than id, unless it is
+// committing already. A wounded transaction gives up its locks at once and
+// fails on its next request; a blocked one is woken immediately.
+func (lm *LockManager) wound(id TxID, others []TxID) {
+	ts := lm.ts(id)
+	for _, other := range others {
+		owner, has := lm.owners[other]
+		if !has || owner.wounded || owner.committing || owner.TS <= ts {
+			continue
+		}
+		owner.wounded = true
+		if req, has := lm.waiting[other]; has {
+			lm.cancel(req, ErrWounded)
+		}
+		lm.release(other)
+	}
+}
+
+// release drops every lock id holds, without ending it.
+func (lm *LockManager) release(id TxID) {
+	released := false
+	for key, info := range lm.Locks {
+		if info.Holders[id] && lm.unlock(id, key) {
+			released = true
+		}
+	}
+	lm.unlockRanges(id)
+	lm.unlockPrefixes(id)
+	if released {
+		lm.grantRanges()
+	}
+}
+
+// seal marks id as committing: its locks have to last until its writes are
+// in, so it can no longer be wounded. It fails if id was wounded already.
+func (lm *LockManager) seal(id TxID) error {
+	lm.latch.Lock()
+	defer lm.latch.Unlock()
+	owner, has := lm.owners[id]
+	if !has {
+		return nil
+	}
+	if owner.wounded {
+		return ErrWounded
+	}
+	owner.committing = true
+	return nil
+}
+
+// grantWaiting hands the lock to queued requests in arrival order, stopping
+// at the first one that is still incompatible with the current holders, or
+// has to wait for a queued range request. Upgrades never do, the range
+// waits for the lock they already hold.
+func (lm *LockManager) grantWaiting(key string, info *LockInfo) {
+	for len(info.Queue) > 0 {
+		req := info.Queue[0]
+		if !info.grantable(req) || lm.rangeConflict(req.TxID, key, req.Shared) ||
+			(!req.Upgrade && len(lm.queuedRanges(req.TxID, key, req.Shared)) > 0) {
+			break
+		}
+		info.Queue = info.Queue[1:]
+		if req.Upgrade {
+			info.Shared = false
+		} else {
+			info.grant(req.TxID, req.Shared)
+		}
+		delete(lm.waiting, req.TxID)
+		close(req.done)
+	}
+	if info.Cnt == 0 && len(info.Queue) == 0 {
+		lm.removeLock(key)
+	}
+}
+
+// addLock and removeLock keep keys in step with Locks.
+func (lm *LockManager) addLock(key string, info *LockInfo) {
+	lm.Locks[key] = info
+	i := sort.SearchStrings(lm.keys, key)
+	lm.keys = append(lm.keys, "")
+	copy(lm.keys[i+1:], lm.keys[i:])
+	lm.keys[i] = key
+}
+
+func (lm *LockManager) removeLock(key string) {
+	delete(lm.Locks, key)
+	i := sort.SearchStrings(lm.keys, key)
+	if i < len(lm.keys) && lm.keys[i] == key {
+		lm.keys = append(lm.keys[:i], lm.keys[i+1:]...)
+	}
+}
+
+// keysIn returns the keys of Locks in [start, end), an empty end leaving
+// the range unbounded above. The result is only valid until Locks changes.
+func (lm *LockManager) keysIn(start string, end string) []string {
+	i := sort.SearchStrings(lm.keys, start)
+	j := len(lm.keys)
+	if end != "" {
+		j = sort.SearchStrings(lm.keys, end)
+	}
+	if j < i {
+		return nil
+	}
+	return lm.keys[i:j]
+}
+
+// withdraw takes back a request that gives up instead of waiting, along
+// with the lock entry it may have created.
+func (lm *LockManager) withdraw(req *LockRequest) {
+	lm.dequeue(req)
+	switch {
+	case req.Range:
+	case req.Prefix:
+		p := lm.Prefixes[req.Key]
+		if len(p.Holders) == 0 && len(p.Queue) == 0 {
+			delete(lm.Prefixes, req.Key)
+		}
+	default:
+		info := lm.Locks[req.Key]
+		if info.Cnt == 0 && len(info.Queue) == 0 {
+			lm.removeLock(req.Key)
+		}
+	}
+}
+
+func (lm *LockManager) cancel(req *LockRequest, err error) {
+	lm.dequeue(req)
+	delete(lm.waiting, req.TxID)
+	req.err = err
+	close(req.done)
+	switch {
+	case req.Range:
+		lm.grantRanges()
+		lm.grantKeys(req.Key, req.End)
+	case req.Prefix:
+		lm.grantPrefix(req.Key, lm.Prefixes[req.Key])
+	default:
+		lm.grantWaiting(req.Key, lm.Locks[req.Key])
+	}
+}
@@ -1,34 +1,45 @@
 package transaction
 
 import (
-	"errors"
+	"bytes"
+	"context"
+	"encoding/binary"
 	"math"
+	"sort"
 	"sync"
 
 	"github.com/Al0ha0e/skv/storage"
 )
 
+// VersionNode is a committed value of a key, WTS being the timestamp of the
+// commit that wrote it.
 type VersionNode struct {
 	Prev  *VersionNode
-	RTS   uint32
-	WTS   uint32
+	WTS   uint64
 	Value []byte
 }
 
-func MakeVersionNode(prev *VersionNode, rts uint32, wts uint32, value []byte) *VersionNode {
+func MakeVersionNode(prev *VersionNode, wts uint64, value []byte) *VersionNode {
 	return &VersionNode{
 		Prev:  prev,
-		RTS:   rts,
 		WTS:   wts,
 		Value: value,
 	}
 }
 
+// MVCCLockManager hands out 64-bit timestamps, used both as start
+// timestamps and as the commit timestamps persisted with every commit. The
+// counter carries on from the highest timestamp found in the store.
 type MVCCLockManager struct {
 	Locks    map[string]int
 	Versions map[string]*VersionNode
+	Active   map[uint64]bool
 	Store    storage.Storage
-	CurrTS   uint32
+	CurrTS   uint64       // latest timestamp handed out
+	CommitTS uint64       // timestamp of the latest commit, the last one history can be read at
+	Writers  *LockManager // optional, shared with two-phase locking transactions
+	Hooks    *Hooks       // optional, run on every commit
+	NextID   TxID         // last transaction id handed out when there is no Writers
 	latch    sync.Mutex
 }
 
@@ -36,11 +47,16 @@ func MakeMVCCLockManager(store storage.Storage) *MVCCLockManager {
 	return &MVCCLockManager{
 		Locks:    make(map[string]int),
 		Versions: make(map[string]*VersionNode),
+		Active:   make(map[uint64]bool),
 		Store:    store,
-		CurrTS:   0,
+		CurrTS:   store.LastTS(),
+		CommitTS: store.LastTS(),
 	}
 }
 
+// getOriVersion loads the stored value of key as the oldest version. A
+// missing key still gets a node, with a nil value, so that its read and
+// write timestamps can be tracked.
 func (lm *MVCCLockManager) getOriVersion(key []byte, skey string) (*VersionNode, error) {
 	lm.Store.Lock()
 	ori, err := lm.Store.Get(key)
@@ -48,39 +64,42 @@ func (lm *MVCCLockManager) getOriVersion(key []byte, skey string) (*VersionNode,
 	if err != nil {
 		return nil, err
 	}
-	if ori != nil {
-		ret := MakeVersionNode(nil, 0, 0, ori)
-		lm.Versions[skey] = ret
-		return ret, nil
+	ret := MakeVersionNode(nil, 0, ori)
+	lm.Versions[skey] = ret
+	return ret, nil
+}
+
+func (lm *MVCCLockManager) getVersion(key []byte, skey string) (*VersionNode, error) {
+	node, has := lm.Versions[skey]
+	if has {
+		return node, nil
 	}
-	return nil, nil
+	return lm.getOriVersion(key, skey)
 }
 
-func (lm *MVCCLockManager) Lock(key []byte, skey string, ts uint32) bool {
+// Lock reserves key for a snapshot that started at ts. Snapshots follow the
+// first committer wins rule: once a newer version of key was committed, the
+// write fails. Reads never make it fail, so write skew goes undetected.
+func (lm *MVCCLockManager) Lock(key []byte, skey string, ts uint64) error {
 	lm.latch.Lock()
 	defer lm.latch.Unlock()
 
 	_, has := lm.Locks[skey]
 	if has {
-		return false
+		return ErrLockConflict
 	}
 
-	var node *VersionNode
-	node, has = lm.Versions[skey]
-	if !has {
-		var err error
-		node, err = lm.getOriVersion(key, skey)
-		if err != nil {
-			return false
-		}
+	node, err := lm.getVersion(key, skey)
+	if err != nil {
+		return err
 	}
 
-	if node.RTS >= ts || node.WTS >= ts {
-		return false
+	if node.WTS > ts {
+		return ErrSerialization
 	}
 
 	lm.Locks[skey] = 1
-	return true
+	return nil
 }
 
 func (lm *MVCCLockManager) Unlock(key string) {
@@ -89,74 +108,317 @@ func (lm *MVCCLockManager) Unlock(key string) {
 	lm.latch.Unlock()
 }
 
-func (lm *MVCCLockManager) UpdateVersion(skey string, value []byte, ts uint32) {
+func (lm *MVCCLockManager) Get(key []byte, skey string, ts uint64) ([]byte, error) {
 	lm.latch.Lock()
-	prev := lm.Versions[skey]
-	lm.Versions[skey] = MakeVersionNode(prev, ts, ts, value)
-	lm.latch.Unlock()
+	defer lm.latch.Unlock()
+	return lm.get(key, skey, ts)
+}
+
+// get walks the version chain of key down to the version visible at ts.
+func (lm *MVCCLockManager) get(key []byte, skey string, ts uint64) ([]byte, error) {
+	node, err := lm.getVersion(key, skey)
+	if err != nil {
+		return nil, err
+	}
+
+	for ; node != nil; node = node.Prev {
+		if node.WTS < ts {
+			break
+		}
+	}
+	if node == nil {
+		return nil, nil
+	}
+	return node.Value, nil
 }
 
-func (lm *MVCCLockManager) Get(key []byte, skey string, ts uint32) ([]byte, error) {
+// scan reads the pairs in [start, end) as of ts, in key order and without
+// the keys deleted by then, stopping after limit of them unless limit is 0.
+// The store is read limit keys at a time.
+func (lm *MVCCLockManager) scan(start []byte, end []byte, ts uint64, limit int) ([]storage.KV, error) {
 	lm.latch.Lock()
 	defer lm.latch.Unlock()
 
-	node, has := lm.Versions[skey]
-	if !has {
-		var err error
-		node, err = lm.getOriVersion(key, skey)
+	ret := make([]storage.KV, 0)
+	for {
+		lm.Store.Lock()
+		kvs, err := lm.Store.Scan(start, end, limit)
+		lm.Store.Unlock()
 		if err != nil {
 			return nil, err
 		}
+		// past the last key of a full batch, the store has more to tell
+		bound, full := end, limit > 0 && len(kvs) == limit
+		if full {
+			bound = append(append([]byte{}, kvs[len(kvs)-1].Key...), 0)
+		}
+
+		keys := make([]string, 0, len(kvs))
+		seen := make(map[string]bool, len(kvs))
+		for _, kv := range kvs {
+			keys = append(keys, string(kv.Key))
+			seen[string(kv.Key)] = true
+		}
+		for skey := range lm.Versions {
+			if !seen[skey] && inRange([]byte(skey), start, bound) {
+				keys = append(keys, skey)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, skey := range keys {
+			value, err := lm.get([]byte(skey), skey, ts)
+			if err != nil {
+				return nil, err
+			}
+			if value == nil {
+				continue
+			}
+			ret = append(ret, storage.KV{Key: []byte(skey), Value: value})
+			if limit > 0 && len(ret) == limit {
+				return ret, nil
+			}
+		}
+		if !full {
+			return ret, nil
+		}
+		start = bound
 	}
+}
 
-	for ; node != nil; node = node.Prev {
-		if node.WTS < ts {
+// Install runs write, which persists new values for keys outside of MVCC at
+// the commit timestamp it is given, and records them as versions at that
+// timestamp so running snapshots keep seeing the values they started with.
+func (lm *MVCCLockManager) Install(keys [][]byte, write func(ts uint64) error) error {
+	lm.latch.Lock()
+	defer lm.latch.Unlock()
+
+	ts, err := lm.nextTS()
+	if err != nil {
+		return err
+	}
+
+	if len(lm.Active) > 0 {
+		for _, key := range keys {
+			_, err := lm.getVersion(key, string(key))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err = write(ts)
+	if err != nil {
+		return err
+	}
+
+	lm.CurrTS = ts
+	lm.CommitTS = ts
+	for _, key := range keys {
+		skey := string(key)
+		prev, has := lm.Versions[skey]
+		if !has {
+			continue
+		}
+		lm.Store.Lock()
+		value, err := lm.Store.Get(key)
+		lm.Store.Unlock()
+		if err != nil {
+			return err
+		}
+		lm.Versions[skey] = MakeVersionNode(prev, lm.CurrTS, value)
+		lm.prune(skey)
+	}
+	return nil
+}
+
+// prune drops the versions of key that no running transaction can read.
+// Chains only exist while some transaction is running; end clears them all
+// once the last one finishes.
+func (lm *MVCCLockManager) prune(skey string) {
+	oldest := lm.CurrTS
+	for ts := range lm.Active {
+		if ts < oldest {
+			oldest = ts
+		}
+	}
+	for node := lm.Versions[skey]; node != nil; node = node.Prev {
+		if node.WTS < oldest {
+			node.Prev = nil
 			break
 		}
 	}
-	node.RTS = uint32(math.Max(float64(node.RTS), float64(ts)))
-	return node.Value, nil
+}
+
+// commit persists kvs, written by a snapshot that started at start, at a new
+// commit timestamp, so that commit timestamps follow the order transactions
+// commit in whatever timestamp they started at. The first committer wins:
+// a key committed by someone else since start fails the commit.
+func (lm *MVCCLockManager) commit(start uint64, kvs []storage.KV, log *txLog) error {
+	lm.latch.Lock()
+	defer lm.latch.Unlock()
+
+	ts, err := lm.nextTS()
+	if err != nil {
+		return err
+	}
+	for _, kv := range kvs {
+		if lm.Versions[string(kv.Key)].WTS > start {
+			return ErrSerialization
+		}
+	}
+
+	lm.Store.Lock()
+	err = log.commit(ts, kvs)
+	lm.Store.Unlock()
+	if err != nil {
+		return err
+	}
+
+	lm.CurrTS = ts
+	lm.CommitTS = ts
+	for _, kv := range kvs {
+		skey := string(kv.Key)
+		lm.Versions[skey] = MakeVersionNode(lm.Versions[skey], ts, kv.Value)
+	}
+	return nil
+}
+
+// nextTS returns the timestamp following CurrTS. Rather than wrap around,
+// which would order new versions before old ones, it fails once the counter
+// is used up.
+func (lm *MVCCLockManager) nextTS() (uint64, error) {
+	if lm.CurrTS == math.MaxUint64 {
+		return 0, ErrTSExhausted
+	}
+	return lm.CurrTS + 1, nil
+}
+
+// LastTS returns the timestamp of the latest commit. Later commits all get
+// higher timestamps, so reads at LastTS or before never change.
+func (lm *MVCCLockManager) LastTS() uint64 {
+	lm.latch.Lock()
+	defer lm.latch.Unlock()
+	return lm.CommitTS
+}
+
+func (lm *MVCCLockManager) begin() (uint64, error) {
+	lm.latch.Lock()
+	defer lm.latch.Unlock()
+	ts, err := lm.nextTS()
+	if err != nil {
+		return 0, err
+	}
+	lm.CurrTS = ts
+	lm.Active[ts] = true
+	return ts, nil
+}
+
+// newID hands out the id a transaction logs its writes under when there is
+// no Writers to take it from. Ids start at 1, so that no two transactions
+// share a log id.
+func (lm *MVCCLockManager) newID() TxID {
+	lm.latch.Lock()
+	defer lm.latch.Unlock()
+	lm.NextID++
+	return lm.NextID
+}
+
+func (lm *MVCCLockManager) end(ts uint64, keys []string) {
+	lm.latch.Lock()
+	defer lm.latch.Unlock()
+	delete(lm.Active, ts)
+	for _, skey := range keys {
+		delete(lm.Locks, skey)
+	}
+	if len(lm.Active) == 0 {
+		lm.Versions = make(map[string]*VersionNode)
+		return
+	}
+	for _, skey := range keys {
+		lm.prune(skey)
+	}
 }
 
 type MVCCInstance struct {
+	ID    TxID
 	LM    *MVCCLockManager
 	Store storage.Storage
 	View  map[string][]byte
 	Locks map[string]int
 	State TxState
-	TS    uint32
+	TS    uint64
+	undo  undoLog
+	log   txLog
+	Hooks
 }
 
-func (lm *MVCCLockManager) MakeMVCCInstance(store storage.Storage) *MVCCInstance {
-	lm.latch.Lock()
-	defer lm.latch.Unlock()
-
-	lm.CurrTS++
-
-	return &MVCCInstance{
+func (lm *MVCCLockManager) MakeMVCCInstance(store storage.Storage) (*MVCCInstance, error) {
+	ts, err := lm.begin()
+	if err != nil {
+		return nil, err
+	}
+	ret := &MVCCInstance{
 		LM:    lm,
 		Store: store,
 		View:  make(map[string][]byte),
 		Locks: make(map[string]int),
 		State: TxStateRunning,
-		TS:    lm.CurrTS,
+		TS:    ts,
 	}
+	if lm.Writers != nil {
+		ret.ID = lm.Writers.Begin()
+	} else {
+		ret.ID = lm.newID()
+	}
+	ret.log = txLog{store: store, id: ret.ID}
+	return ret, nil
 }
 
-func (mvcc *MVCCInstance) unlockAllLocks() {
+func (mvcc *MVCCInstance) lockedKeys() []string {
+	keys := make([]string, 0, len(mvcc.Locks))
 	for key := range mvcc.Locks {
-		mvcc.LM.Unlock(key)
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (mvcc *MVCCInstance) finish(state TxState) {
+	keys := mvcc.lockedKeys()
+	mvcc.LM.end(mvcc.TS, keys)
+	if mvcc.LM.Writers != nil {
+		for _, key := range keys {
+			mvcc.LM.Writers.Unlock(mvcc.ID, key)
+		}
+		mvcc.LM.Writers.End(mvcc.ID)
 	}
+	mvcc.State = state
 }
 
 func (mvcc *MVCCInstance) abort() {
-	mvcc.unlockAllLocks()
-	mvcc.State = TxStateAborted
+	mvcc.log.abort()
+	mvcc.finish(TxStateAborted)
 }
 
-func (mvcc *MVCCInstance) Get(key []byte) (value []byte, err error) {
+func (mvcc *MVCCInstance) check(ctx context.Context) error {
 	if mvcc.State != TxStateRunning {
-		return nil, errors.New("tx not running")
+		return ErrNotRunning
+	}
+	if err := ctx.Err(); err != nil {
+		mvcc.abort()
+		return err
+	}
+	if mvcc.LM.Writers != nil && mvcc.LM.Writers.Wounded(mvcc.ID) {
+		// its write locks are gone already
+		mvcc.abort()
+		return ErrWounded
+	}
+	return nil
+}
+
+func (mvcc *MVCCInstance) Get(ctx context.Context, key []byte) (value []byte, err error) {
+	if err = mvcc.check(ctx); err != nil {
+		return nil, err
 	}
 
 	skey := string(key)
@@ -174,67 +436,186 @@ func (mvcc *MVCCInstance) Get(key []byte) (value []byte, err error) {
 	return value, nil
 }
 
-func (mvcc *MVCCInstance) GetForUpdate(key []byte) (value []byte, err error) {
-	return nil, nil
+// lock reserves key for writing. Besides the timestamp checks, writers also
+// take the exclusive lock two-phase locking transactions use, so the two
+// schemes never overwrite each other's pending changes.
+func (mvcc *MVCCInstance) lock(ctx context.Context, key []byte, skey string) error {
+	_, has := mvcc.Locks[skey]
+	if has {
+		return nil
+	}
+	if err := mvcc.LM.Lock(key, skey, mvcc.TS); err != nil {
+		mvcc.abort()
+		return err
+	}
+	mvcc.Locks[skey] = 1
+	if mvcc.LM.Writers != nil {
+		if err := mvcc.LM.Writers.Lock(ctx, mvcc.ID, skey, false); err != nil {
+			mvcc.abort()
+			return err
+		}
+	}
+	return nil
 }
 
-func (mvcc *MVCCInstance) Put(key []byte, value []byte) (err error) {
-	if mvcc.State != TxStateRunning {
-		return errors.New("tx not running")
+func (mvcc *MVCCInstance) GetForUpdate(ctx context.Context, key []byte) (value []byte, err error) {
+	if err = mvcc.check(ctx); err != nil {
+		return nil, err
+	}
+	if err = mvcc.lock(ctx, key, string(key)); err != nil {
+		return nil, err
+	}
+	return mvcc.Get(ctx, key)
+}
+
+func (mvcc *MVCCInstance) Put(ctx context.Context, key []byte, value []byte) (err error) {
+	if err = mvcc.check(ctx); err != nil {
+		return err
 	}
 
 	skey := string(key)
-	_, has := mvcc.Locks[skey]
-	if !has {
-		if !mvcc.LM.Lock(key, skey, mvcc.TS) {
+	if err = mvcc.lock(ctx, key, skey); err != nil {
+		return err
+	}
+
+	return mvcc.write(skey, value)
+}
+
+// write changes key in the View, logging the change ahead of the commit.
+func (mvcc *MVCCInstance) write(key string, value []byte) error {
+	mvcc.undo.write(mvcc.View, key, value, mvcc.log.written[key])
+	if err := mvcc.log.write(key, value); err != nil {
+		mvcc.abort()
+		return err
+	}
+	return nil
+}
+
+func (mvcc *MVCCInstance) PutBatch(ctx context.Context, kvs []storage.KV) (err error) {
+	for _, kv := range kvs {
+		if err = mvcc.Put(ctx, kv.Key, kv.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Scan reads the snapshot, so keys committed after the transaction started
+// are never seen and need no locking.
+func (mvcc *MVCCInstance) Scan(ctx context.Context, start []byte, end []byte) (kvs []storage.KV, err error) {
+	return mvcc.ScanLimit(ctx, start, end, 0)
+}
+
+func (mvcc *MVCCInstance) ScanLimit(ctx context.Context, start []byte, end []byte, limit int) (kvs []storage.KV, err error) {
+	if err = mvcc.check(ctx); err != nil {
+		return nil, err
+	}
+
+	read := func(start []byte, end []byte, limit int) ([]storage.KV, error) {
+		return mvcc.LM.scan(start, end, mvcc.TS, limit)
+	}
+	kvs, err = scanMerged(read, mvcc.View, start, end, limit)
+	if err != nil {
+		mvcc.abort()
+		return nil, err
+	}
+	return kvs, nil
+}
+
+func (mvcc *MVCCInstance) PrefixScan(ctx context.Context, prefix []byte) (kvs []storage.KV, err error) {
+	return mvcc.Scan(ctx, prefix, PrefixEnd(prefix))
+}
+
+func (mvcc *MVCCInstance) Increase32(ctx context.Context, key []byte, inc int32) (err error) {
+	value, err := mvcc.GetForUpdate(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	ivalue := int32(0)
+	if value != nil {
+		err = binary.Read(bytes.NewBuffer(value), binary.BigEndian, &ivalue)
+		if err != nil {
 			mvcc.abort()
-			return errors.New("abort")
+			return err
 		}
-		mvcc.Locks[skey] = 1
 	}
 
-	mvcc.View[skey] = value
-	return nil
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.BigEndian, ivalue+inc)
+	return mvcc.write(string(key), buf.Bytes())
+}
+
+func (mvcc *MVCCInstance) Delete(ctx context.Context, key []byte) (err error) {
+	return mvcc.Put(ctx, key, nil)
 }
 
-func (mvcc *MVCCInstance) Increase32(key []byte, value int32) (err error) {
+func (mvcc *MVCCInstance) Savepoint(name string) (err error) {
+	if mvcc.State != TxStateRunning {
+		return ErrNotRunning
+	}
+	mvcc.undo.savepoint(name)
 	return nil
 }
 
-func (mvcc *MVCCInstance) Delete(key []byte) (err error) {
-	return mvcc.Put(key, nil)
+func (mvcc *MVCCInstance) RollbackTo(name string) (err error) {
+	if mvcc.State != TxStateRunning {
+		return ErrNotRunning
+	}
+	undone, err := mvcc.undo.rollbackTo(mvcc.View, name)
+	if err != nil {
+		return err
+	}
+	if err = mvcc.log.restore(undone); err != nil {
+		mvcc.abort()
+	}
+	return err
 }
 
 func (mvcc *MVCCInstance) Commit() (err error) {
 	if mvcc.State != TxStateRunning {
-		return errors.New("tx not running")
+		return ErrNotRunning
 	}
 
-	kvs := make([]storage.KV, len(mvcc.Locks))
-	i := 0
-	for k := range mvcc.Locks {
-		kvs[i] = storage.KV{Key: []byte(k), Value: mvcc.View[k]}
-		i += 1
+	err = mvcc.LM.Hooks.preCommit(mvcc, mvcc.writes())
+	if err == nil {
+		err = mvcc.Hooks.preCommit(mvcc, mvcc.writes())
+	}
+	if err != nil {
+		// a hook's own write may have aborted the transaction already
+		if mvcc.State == TxStateRunning {
+			mvcc.abort()
+		}
+		return err
+	}
+
+	if mvcc.LM.Writers != nil {
+		if err = mvcc.LM.Writers.seal(mvcc.ID); err != nil {
+			mvcc.abort()
+			return err
+		}
 	}
 
-	mvcc.Store.Lock()
-	err = mvcc.Store.PutBatch(kvs)
-	mvcc.Store.Unlock()
+	kvs := mvcc.writes()
+	err = mvcc.LM.commit(mvcc.TS, kvs, &mvcc.log)
 	if err != nil {
 		mvcc.abort()
 		return err
 	}
 
-	for k := range mvcc.Locks {
-		mvcc.LM.UpdateVersion(string(k), mvcc.View[k], mvcc.TS)
-	}
-	mvcc.unlockAllLocks()
+	mvcc.finish(TxStateCommitted)
+	mvcc.LM.Hooks.postCommit(kvs)
+	mvcc.Hooks.postCommit(kvs)
 	return nil
 }
 
+func (mvcc *MVCCInstance) writes() []storage.KV {
+	return mvcc.log.writes(mvcc.View)
+}
+
 func (mvcc *MVCCInstance) Abort() (err error) {
 	if mvcc.State != TxStateRunning {
-		return errors.New("tx not running")
+		return ErrNotRunning
 	}
 	mvcc.abort()
 	return nil
@@ -0,0 +1,419 @@
+package transaction
+
+import (
+	"math"
+	"os"
+	"testing"
+
+	"github.com/Al0ha0e/skv/storage"
+)
+
+func makeTestManagers() (*LockManager, *MVCCLockManager, storage.Storage) {
+	store := storage.MakeNaiveStorage()
+	lm := MakeLockManager(LockPolicyNoWait)
+	mvcc := MakeMVCCLockManager(store)
+	mvcc.Writers = lm
+	lm.Versions = mvcc
+	return lm, mvcc, store
+}
+
+func TestSnapshotRead(t *testing.T) {
+	lm, mvcc, store := makeTestManagers()
+	store.Put([]byte{1}, []byte{11})
+
+	snap, _ := mvcc.MakeMVCCInstance(store)
+	writer := lm.MakeTwoPLInstance(store)
+	writer.Put(ctx, []byte{1}, []byte{22})
+	writer.Put(ctx, []byte{2}, []byte{33})
+	if err := writer.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := snap.Get(ctx, []byte{1})
+	if err != nil || v[0] != 11 {
+		t.Fatal("snapshot saw a later commit", v, err)
+	}
+	v, _ = snap.Get(ctx, []byte{2})
+	if v != nil {
+		t.Fatal("snapshot saw a later insert", v)
+	}
+	if err = snap.Put(ctx, []byte{1}, []byte{44}); err != ErrSerialization {
+		t.Fatal("expected first committer to win", err)
+	}
+
+	snap, _ = mvcc.MakeMVCCInstance(store)
+	v, _ = snap.Get(ctx, []byte{1})
+	if v[0] != 22 {
+		t.Fatal("new snapshot missed a commit", v)
+	}
+	snap.Put(ctx, []byte{1}, []byte{55})
+	if err = snap.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	v, _ = store.Get([]byte{1})
+	if v[0] != 55 {
+		t.Error("bad value", v)
+	}
+	if len(mvcc.Versions) != 0 || len(mvcc.Active) != 0 {
+		t.Error("versions kept after last transaction", mvcc.Versions)
+	}
+}
+
+func TestSnapshotCommitTS(t *testing.T) {
+	lm, mvcc, store := makeTestManagers()
+
+	snap, _ := mvcc.MakeMVCCInstance(store)
+	snap.Put(ctx, []byte{1}, []byte{11})
+	writer := lm.MakeTwoPLInstance(store)
+	writer.Put(ctx, []byte{2}, []byte{22})
+	if err := writer.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	written := mvcc.LastTS()
+	if err := snap.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the snapshot committed last, after the timestamp of the other commit
+	if mvcc.LastTS() <= written || store.LastTS() != mvcc.LastTS() {
+		t.Fatal("snapshot committed at its start timestamp", snap.TS, written, mvcc.LastTS())
+	}
+	if v, _ := store.GetAt([]byte{1}, written); v != nil {
+		t.Fatal("snapshot commit visible before it happened", v)
+	}
+	if v, _ := store.GetAt([]byte{1}, mvcc.LastTS()); v == nil || v[0] != 11 {
+		t.Fatal("snapshot commit missing at its commit timestamp", v)
+	}
+}
+
+func TestSnapshotWriteLock(t *testing.T) {
+	lm, mvcc, store := makeTestManagers()
+
+	writer := lm.MakeTwoPLInstance(store)
+	writer.Put(ctx, []byte{1}, []byte{11})
+
+	snap, _ := mvcc.MakeMVCCInstance(store)
+	if err := snap.Put(ctx, []byte{1}, []byte{22}); err != ErrLockConflict {
+		t.Fatal("snapshot overwrote a pending two-phase locking write", err)
+	}
+	writer.Commit()
+}
+
+func TestReadCommitted(t *testing.T) {
+	lm, _, store := makeTestManagers()
+	store.Put([]byte{1}, []byte{11})
+
+	reader := lm.MakeTwoPLInstance(store)
+	reader.Isolation = IsolationReadCommitted
+	v, _ := reader.Get(ctx, []byte{1})
+	if v[0] != 11 {
+		t.Fatal("bad value", v)
+	}
+
+	writer := lm.MakeTwoPLInstance(store)
+	if err := writer.Put(ctx, []byte{1}, []byte{22}); err != nil {
+		t.Fatal("read committed kept its shared lock", err)
+	}
+	writer.Commit()
+
+	v, _ = reader.Get(ctx, []byte{1})
+	if v[0] != 22 {
+		t.Fatal("read committed did not see the new commit", v)
+	}
+	reader.Commit()
+}
+
+func TestReadOnly(t *testing.T) {
+	lm, mvcc, store := makeTestManagers()
+	store.Put([]byte{1}, []byte{11})
+
+	writer := lm.MakeTwoPLInstance(store)
+	writer.Get(ctx, []byte{1})
+
+	ro, _ := mvcc.MakeReadOnlyInstance()
+	v, err := ro.Get(ctx, []byte{1})
+	if err != nil || v[0] != 11 {
+		t.Fatal("bad value", v, err)
+	}
+
+	if err = writer.Put(ctx, []byte{1}, []byte{22}); err != nil {
+		t.Fatal("read-only transaction blocked a writer", err)
+	}
+	writer.Commit()
+
+	v, _ = ro.Get(ctx, []byte{1})
+	if v[0] != 11 {
+		t.Fatal("read-only transaction saw a later commit", v)
+	}
+	if err = ro.Put(ctx, []byte{1}, []byte{33}); err != ErrReadOnlyTx {
+		t.Fatal("write accepted", err)
+	}
+	if err = ro.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err = ro.Commit(); err != nil {
+		t.Fatal("commit of a read-only transaction must always succeed", err)
+	}
+	if len(mvcc.Active) != 0 {
+		t.Error("read-only transaction still registered")
+	}
+}
+
+func TestReadOnlyNeverAbortsWriters(t *testing.T) {
+	_, mvcc, store := makeTestManagers()
+	store.Put([]byte{1}, []byte{11})
+	store.Put([]byte{2}, []byte{22})
+
+	snap, _ := mvcc.MakeMVCCInstance(store)
+	ro, _ := mvcc.MakeReadOnlyInstance()
+	ro.Get(ctx, []byte{1})
+	ro.Scan(ctx, []byte{2}, []byte{3})
+
+	// the reader is newer than the snapshot, which must still write
+	if err := snap.Put(ctx, []byte{1}, []byte{33}); err != nil {
+		t.Fatal("read-only read aborted an older writer", err)
+	}
+	if err := snap.Put(ctx, []byte{2}, []byte{44}); err != nil {
+		t.Fatal("read-only scan aborted an older writer", err)
+	}
+	if err := snap.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := ro.Get(ctx, []byte{1}); v[0] != 11 {
+		t.Fatal("read-only transaction saw a later commit", v)
+	}
+	ro.Commit()
+}
+
+func TestSnapshotFirstCommitterWins(t *testing.T) {
+	_, mvcc, store := makeTestManagers()
+	store.Put([]byte{1}, []byte{1})
+	store.Put([]byte{2}, []byte{1})
+
+	older, _ := mvcc.MakeMVCCInstance(store)
+	newer, _ := mvcc.MakeMVCCInstance(store)
+	newer.Get(ctx, []byte{1})
+	newer.Get(ctx, []byte{2})
+	older.Get(ctx, []byte{1})
+	older.Get(ctx, []byte{2})
+
+	// a newer reader does not abort an older writer, and the disjoint
+	// writes of the two both commit, write skew included
+	if err := older.Put(ctx, []byte{1}, []byte{0}); err != nil {
+		t.Fatal("newer reader aborted an older writer", err)
+	}
+	if err := newer.Put(ctx, []byte{2}, []byte{0}); err != nil {
+		t.Fatal(err)
+	}
+	if err := older.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := newer.Commit(); err != nil {
+		t.Fatal("disjoint writes conflicted", err)
+	}
+
+	first, _ := mvcc.MakeMVCCInstance(store)
+	second, _ := mvcc.MakeMVCCInstance(store)
+	first.Put(ctx, []byte{1}, []byte{3})
+	first.Commit()
+	if err := second.Put(ctx, []byte{1}, []byte{4}); err != ErrSerialization {
+		t.Fatal("expected first committer to win", err)
+	}
+}
+
+func TestSnapshotScan(t *testing.T) {
+	lm, mvcc, store := makeTestManagers()
+	store.Put([]byte("a1"), []byte{1})
+	store.Put([]byte("a2"), []byte{2})
+
+	snap, _ := mvcc.MakeMVCCInstance(store)
+	writer := lm.MakeTwoPLInstance(store)
+	writer.Put(ctx, []byte("a3"), []byte{3})
+	writer.Delete(ctx, []byte("a1"))
+	if err := writer.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	snap.PutBatch(ctx, []storage.KV{{Key: []byte("a0"), Value: []byte{0}}, {Key: []byte("a2"), Value: nil}})
+	kvs, err := snap.PrefixScan(ctx, []byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != 2 || string(kvs[0].Key) != "a0" || string(kvs[1].Key) != "a1" {
+		t.Fatal("bad snapshot scan", kvs)
+	}
+	snap.Abort()
+
+	ro, _ := mvcc.MakeReadOnlyInstance()
+	kvs, _ = ro.Scan(ctx, []byte("a2"), nil)
+	if len(kvs) != 2 || kvs[1].Value[0] != 3 {
+		t.Fatal("bad read-only scan", kvs)
+	}
+	ro.Commit()
+}
+
+func TestReadOnlyCommitHooks(t *testing.T) {
+	_, mvcc, _ := makeTestManagers()
+	mvcc.Hooks = &Hooks{}
+	mvcc.Hooks.OnPreCommit(func(tx Transaction, writes []storage.KV) error {
+		return ErrNotRunning
+	})
+	committed := false
+	mvcc.Hooks.OnPostCommit(func(keys [][]byte) {
+		committed = true
+	})
+
+	ro, _ := mvcc.MakeReadOnlyInstance()
+	if err := ro.Commit(); err != nil || ro.State != TxStateCommitted {
+		t.Fatal("read-only commit vetoed", err)
+	}
+	if !committed {
+		t.Error("post-commit hook did not run")
+	}
+}
+
+func TestReadOnlyScanLimit(t *testing.T) {
+	lm, mvcc, store := makeTestManagers()
+	for _, key := range []string{"a1", "a2", "a3", "a4"} {
+		store.Put([]byte(key), []byte(key))
+	}
+
+	ro, _ := mvcc.MakeReadOnlyInstance()
+	writer := lm.MakeTwoPLInstance(store)
+	writer.Delete(ctx, []byte("a2"))
+	writer.Put(ctx, []byte("a0"), []byte("a0"))
+	if err := writer.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a2 is gone from the store but still in the snapshot, a0 the other way
+	// round
+	kvs, err := ro.ScanLimit(ctx, []byte("a"), nil, 2)
+	if err != nil || len(kvs) != 2 || string(kvs[0].Key) != "a1" || string(kvs[1].Key) != "a2" {
+		t.Fatal("bad limited scan", kvs, err)
+	}
+	kvs, _ = ro.ScanLimit(ctx, []byte("a3"), nil, 2)
+	if len(kvs) != 2 || string(kvs[1].Key) != "a4" {
+		t.Fatal("bad limited scan", kvs)
+	}
+	ro.Commit()
+
+	ro, _ = mvcc.MakeReadOnlyInstance()
+	kvs, _ = ro.ScanLimit(ctx, []byte("a"), nil, 3)
+	if len(kvs) != 3 || string(kvs[0].Key) != "a0" || string(kvs[2].Key) != "a3" {
+		t.Fatal("bad limited scan", kvs)
+	}
+	ro.Commit()
+}
+
+func TestScanLimitOwnWrites(t *testing.T) {
+	lm, mvcc, store := makeTestManagers()
+	for _, key := range []string{"a1", "a2", "a3", "a4"} {
+		store.Put([]byte(key), []byte(key))
+	}
+
+	begin := []func() Transaction{
+		func() Transaction { return lm.MakeTwoPLInstance(store) },
+		func() Transaction { snap, _ := mvcc.MakeMVCCInstance(store); return snap },
+	}
+	for _, makeTx := range begin {
+		tx := makeTx()
+		// the deletions empty the first batch read from the store
+		tx.Delete(ctx, []byte("a1"))
+		tx.Delete(ctx, []byte("a2"))
+		tx.Put(ctx, []byte("a5"), []byte("a5"))
+		kvs, err := tx.ScanLimit(ctx, []byte("a"), nil, 2)
+		if err != nil || len(kvs) != 2 || string(kvs[0].Key) != "a3" || string(kvs[1].Key) != "a4" {
+			t.Errorf("%T: bad limited scan %v %v", tx, kvs, err)
+		}
+		kvs, _ = tx.ScanLimit(ctx, []byte("a4"), nil, 5)
+		if len(kvs) != 2 || string(kvs[1].Key) != "a5" {
+			t.Errorf("%T: bad limited scan %v", tx, kvs)
+		}
+		tx.Abort()
+	}
+}
+
+func TestTimestampExhausted(t *testing.T) {
+	_, mvcc, store := makeTestManagers()
+	mvcc.CurrTS = math.MaxUint64 - 2
+
+	snap, err := mvcc.MakeMVCCInstance(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap.Put(ctx, []byte{1}, []byte{1})
+	if err = snap.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if store.LastTS() != math.MaxUint64 {
+		t.Error("commit not stamped with its timestamp", store.LastTS())
+	}
+
+	if _, err = mvcc.MakeMVCCInstance(store); err != ErrTSExhausted {
+		t.Fatal("timestamp wrapped around", err)
+	}
+	if err = mvcc.Install([][]byte{{1}}, func(ts uint64) error { return nil }); err != ErrTSExhausted {
+		t.Fatal("timestamp wrapped around", err)
+	}
+}
+
+func TestSnapshotCommitHooks(t *testing.T) {
+	_, mvcc, store := makeTestManagers()
+	mvcc.Hooks = &Hooks{}
+	var committed [][]byte
+	mvcc.Hooks.OnPostCommit(func(keys [][]byte) {
+		committed = keys
+	})
+
+	snap, _ := mvcc.MakeMVCCInstance(store)
+	snap.OnPreCommit(func(tx Transaction, writes []storage.KV) error {
+		return ErrReadOnlyTx
+	})
+	snap.Put(ctx, []byte{1}, []byte{1})
+	if err := snap.Commit(); err != ErrReadOnlyTx || committed != nil {
+		t.Fatal("commit not vetoed", err)
+	}
+
+	snap, _ = mvcc.MakeMVCCInstance(store)
+	snap.Put(ctx, []byte{2}, []byte{2})
+	if err := snap.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if len(committed) != 1 || committed[0][0] != 2 {
+		t.Fatal("bad post-commit keys", committed)
+	}
+}
+
+func TestSnapshotLogIDs(t *testing.T) {
+	os.Remove("../testdata/snapshotids.skv")
+	store, err := storage.OpenBitcask("../testdata/snapshotids.skv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mvcc := MakeMVCCLockManager(store)
+
+	t1, _ := mvcc.MakeMVCCInstance(store)
+	t2, _ := mvcc.MakeMVCCInstance(store)
+	if t1.ID == 0 || t1.ID == t2.ID {
+		t.Fatal("snapshots share a log id", t1.ID, t2.ID)
+	}
+	t2.Put(ctx, []byte{2}, []byte{22})
+	t1.Put(ctx, []byte{1}, []byte{11})
+	if err := t2.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	store, err = storage.OpenBitcask("../testdata/snapshotids.skv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if v, _ := store.Get([]byte{2}); len(v) != 1 || v[0] != 22 {
+		t.Error("committed write lost", v)
+	}
+	if v, _ := store.Get([]byte{1}); v != nil {
+		t.Error("write of an unfinished snapshot replayed", v)
+	}
+}
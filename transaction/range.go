@@ -0,0 +1,172 @@
+package transaction
+
+import "context"
+
+// RangeLock covers the keys in [Start, End). An empty End leaves the range
+// unbounded above. Holding a shared range lock keeps other transactions from
+// inserting, updating or deleting any key inside it, which is what makes
+// range reads free of phantoms.
+type RangeLock struct {
+	TxID   TxID
+	Start  string
+	End    string
+	Shared bool
+}
+
+func (r *RangeLock) contains(key string) bool {
+	return key >= r.Start && (r.End == "" || key < r.End)
+}
+
+func (r *RangeLock) overlaps(start string, end string) bool {
+	return (end == "" || r.Start < end) && (r.End == "" || start < r.End)
+}
+
+func MakeRangeRequest(id TxID, start string, end string, shared bool) *LockRequest {
+	req := MakeLockRequest(id, start, shared)
+	req.End = end
+	req.Range = true
+	return req
+}
+
+func (lm *LockManager) LockRange(ctx context.Context, id TxID, start string, end string, shared bool) error {
+	lm.latch.Lock()
+
+	if owner, has := lm.owners[id]; has && owner.wounded {
+		lm.latch.Unlock()
+		return ErrWounded
+	}
+
+	req := MakeRangeRequest(id, start, end, shared)
+	if len(lm.rangeBlockers(req)) == 0 {
+		lm.Ranges = append(lm.Ranges, &RangeLock{TxID: id, Start: start, End: end, Shared: shared})
+		lm.latch.Unlock()
+		return nil
+	}
+
+	return lm.block(ctx, req)
+}
+
+// UnlockRanges releases every range lock held by id.
+func (lm *LockManager) UnlockRanges(id TxID) {
+	lm.latch.Lock()
+	defer lm.latch.Unlock()
+	lm.unlockRanges(id)
+}
+
+func (lm *LockManager) unlockRanges(id TxID) {
+	kept := make([]*RangeLock, 0, len(lm.Ranges))
+	released := make([]*RangeLock, 0)
+	for _, r := range lm.Ranges {
+		if r.TxID != id {
+			kept = append(kept, r)
+		} else {
+			released = append(released, r)
+		}
+	}
+	if len(released) == 0 {
+		return
+	}
+	lm.Ranges = kept
+
+	for _, r := range released {
+		lm.grantKeys(r.Start, r.End)
+	}
+	for prefix, p := range lm.Prefixes {
+		if len(p.Queue) > 0 {
+			lm.grantPrefix(prefix, p)
+		}
+	}
+	lm.grantRanges()
+}
+
+// rangeHolders returns the other transactions whose range locks conflict
+// with id locking key in the given mode.
+func (lm *LockManager) rangeHolders(id TxID, key string, shared bool) []TxID {
+	ret := make([]TxID, 0)
+	for _, r := range lm.Ranges {
+		if r.TxID != id && r.contains(key) && !(r.Shared && shared) {
+			ret = append(ret, r.TxID)
+		}
+	}
+	return ret
+}
+
+func (lm *LockManager) rangeConflict(id TxID, key string, shared bool) bool {
+	return len(lm.rangeHolders(id, key, shared)) > 0
+}
+
+func (lm *LockManager) rangeBlockers(req *LockRequest) []TxID {
+	ret := make([]TxID, 0)
+	for _, r := range lm.Ranges {
+		if r.TxID != req.TxID && r.overlaps(req.Key, req.End) && !(r.Shared && req.Shared) {
+			ret = append(ret, r.TxID)
+		}
+	}
+
+	// keys written under an exclusively held prefix carry no key locks
+	for prefix, p := range lm.Prefixes {
+		span := prefixRange(prefix)
+		if !span.overlaps(req.Key, req.End) {
+			continue
+		}
+		for holder, held := range p.Holders {
+			if holder != req.TxID && rangeConflicts(held, req.Shared) {
+				ret = append(ret, holder)
+			}
+		}
+	}
+
+	for _, key := range lm.keysIn(req.Key, req.End) {
+		info := lm.Locks[key]
+		if req.Shared && info.Shared {
+			continue
+		}
+		for holder := range info.Holders {
+			if holder != req.TxID {
+				ret = append(ret, holder)
+			}
+		}
+	}
+	return ret
+}
+
+// queuedRanges returns the other transactions whose queued range requests
+// conflict with id locking key in the given mode. Key requests wait behind
+// them, or a stream of them could keep a range request waiting forever.
+func (lm *LockManager) queuedRanges(id TxID, key string, shared bool) []TxID {
+	ret := make([]TxID, 0)
+	for _, req := range lm.rangeQueue {
+		r := RangeLock{Start: req.Key, End: req.End}
+		if req.TxID != id && r.contains(key) && !(req.Shared && shared) {
+			ret = append(ret, req.TxID)
+		}
+	}
+	return ret
+}
+
+// grantKeys hands the locks of the keys in [start, end) to the requests
+// waiting for them, once a range lock over them is gone.
+func (lm *LockManager) grantKeys(start string, end string) {
+	// granting may drop keys from the index
+	for _, key := range append([]string{}, lm.keysIn(start, end)...) {
+		if info, has := lm.Locks[key]; has && len(info.Queue) > 0 {
+			lm.grantWaiting(key, info)
+		}
+	}
+}
+
+// grantRanges grants every queued range request that no longer conflicts.
+// Range requests do not queue behind each other since they rarely overlap.
+func (lm *LockManager) grantRanges() {
+	for i := 0; i < len(lm.rangeQueue); {
+		req := lm.rangeQueue[i]
+		if len(lm.rangeBlockers(req)) > 0 {
+			i++
+			continue
+		}
+		lm.rangeQueue = append(lm.rangeQueue[:i], lm.rangeQueue[i+1:]...)
+		lm.Ranges = append(lm.Ranges, &RangeLock{TxID: req.TxID, Start: req.Key, End: req.End, Shared: req.Shared})
+		delete(lm.waiting, req.TxID)
+		close(req.done)
+	}
+}
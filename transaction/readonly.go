@@ -0,0 +1,163 @@
+package transaction
+
+import (
+	"context"
+
+	"github.com/Al0ha0e/skv/storage"
+)
+
+// ReadOnlyInstance reads the versions visible at its start timestamp. It
+// takes no locks, so it never blocks writers nor is blocked by them. A
+// pinned instance reads at a past timestamp from the history kept by the
+// store instead.
+type ReadOnlyInstance struct {
+	LM     *MVCCLockManager
+	State  TxState
+	TS     uint64
+	Pinned bool
+	undo   undoLog
+	Hooks
+}
+
+func (lm *MVCCLockManager) MakeReadOnlyInstance() (*ReadOnlyInstance, error) {
+	ts, err := lm.begin()
+	if err != nil {
+		return nil, err
+	}
+	return &ReadOnlyInstance{
+		LM:    lm,
+		State: TxStateRunning,
+		TS:    ts,
+	}, nil
+}
+
+// MakeReadOnlyInstanceAt starts a read-only transaction seeing the values
+// committed up to ts. Reads fail once ts falls out of the retention window.
+func (lm *MVCCLockManager) MakeReadOnlyInstanceAt(ts uint64) (*ReadOnlyInstance, error) {
+	lm.latch.Lock()
+	defer lm.latch.Unlock()
+	if ts > lm.CommitTS {
+		return nil, ErrFutureTS
+	}
+	return &ReadOnlyInstance{
+		LM:     lm,
+		State:  TxStateRunning,
+		TS:     ts,
+		Pinned: true,
+	}, nil
+}
+
+func (ro *ReadOnlyInstance) finish(state TxState) {
+	if ro.State == TxStateRunning {
+		if !ro.Pinned {
+			ro.LM.end(ro.TS, nil)
+		}
+		ro.State = state
+	}
+}
+
+func (ro *ReadOnlyInstance) Get(ctx context.Context, key []byte) (value []byte, err error) {
+	if ro.State != TxStateRunning {
+		return nil, ErrNotRunning
+	}
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+	if ro.Pinned {
+		ro.LM.Store.Lock()
+		defer ro.LM.Store.Unlock()
+		return ro.LM.Store.GetAt(key, ro.TS)
+	}
+	return ro.LM.Get(key, string(key), ro.TS)
+}
+
+func (ro *ReadOnlyInstance) Scan(ctx context.Context, start []byte, end []byte) (kvs []storage.KV, err error) {
+	if ro.State != TxStateRunning {
+		return nil, ErrNotRunning
+	}
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+	if ro.Pinned {
+		ro.LM.Store.Lock()
+		defer ro.LM.Store.Unlock()
+		return ro.LM.Store.ScanAt(start, end, ro.TS)
+	}
+	return ro.LM.scan(start, end, ro.TS, 0)
+}
+
+// ScanLimit reads no more of the store than it returns, unless pinned to a
+// past timestamp, whose versions are all in memory.
+func (ro *ReadOnlyInstance) ScanLimit(ctx context.Context, start []byte, end []byte, limit int) (kvs []storage.KV, err error) {
+	if ro.State != TxStateRunning {
+		return nil, ErrNotRunning
+	}
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+	if ro.Pinned {
+		ro.LM.Store.Lock()
+		defer ro.LM.Store.Unlock()
+		kvs, err = ro.LM.Store.ScanAt(start, end, ro.TS)
+		return firstPairs(kvs, limit), err
+	}
+	return ro.LM.scan(start, end, ro.TS, limit)
+}
+
+func (ro *ReadOnlyInstance) PrefixScan(ctx context.Context, prefix []byte) (kvs []storage.KV, err error) {
+	return ro.Scan(ctx, prefix, PrefixEnd(prefix))
+}
+
+func (ro *ReadOnlyInstance) GetForUpdate(ctx context.Context, key []byte) (value []byte, err error) {
+	return nil, ErrReadOnlyTx
+}
+
+func (ro *ReadOnlyInstance) Put(ctx context.Context, key []byte, value []byte) (err error) {
+	return ErrReadOnlyTx
+}
+
+func (ro *ReadOnlyInstance) PutBatch(ctx context.Context, kvs []storage.KV) (err error) {
+	return ErrReadOnlyTx
+}
+
+func (ro *ReadOnlyInstance) Increase32(ctx context.Context, key []byte, value int32) (err error) {
+	return ErrReadOnlyTx
+}
+
+func (ro *ReadOnlyInstance) Delete(ctx context.Context, key []byte) (err error) {
+	return ErrReadOnlyTx
+}
+
+func (ro *ReadOnlyInstance) Savepoint(name string) (err error) {
+	if ro.State != TxStateRunning {
+		return ErrNotRunning
+	}
+	ro.undo.savepoint(name)
+	return nil
+}
+
+func (ro *ReadOnlyInstance) RollbackTo(name string) (err error) {
+	if ro.State != TxStateRunning {
+		return ErrNotRunning
+	}
+	_, err = ro.undo.rollbackTo(nil, name)
+	return err
+}
+
+// Commit runs the commit hooks like any other commit, with nothing written.
+// Commit ends the transaction. It wrote nothing, so pre-commit hooks, which
+// could only veto the commit, do not run.
+func (ro *ReadOnlyInstance) Commit() (err error) {
+	if ro.State != TxStateRunning {
+		return nil
+	}
+	ro.finish(TxStateCommitted)
+	ro.LM.Hooks.postCommit(nil)
+	ro.Hooks.postCommit(nil)
+	return nil
+}
+
+func (ro *ReadOnlyInstance) Abort() (err error) {
+	ro.finish(TxStateAborted)
+	return nil
+}
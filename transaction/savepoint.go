@@ -0,0 +1,60 @@
+package transaction
+
+type undoRecord struct {
+	Key     string
+	Value   []byte
+	Existed bool
+	Written bool // the old value was a logged write, not just a read
+}
+
+type savepoint struct {
+	Name string
+	Pos  int
+}
+
+// undoLog remembers what each write replaced in a transaction's View so the
+// View can be rolled back to a savepoint. Locks are not part of the log and
+// stay held after a rollback.
+type undoLog struct {
+	records    []undoRecord
+	savepoints []savepoint
+}
+
+func (log *undoLog) write(view map[string][]byte, key string, value []byte, written bool) {
+	old, existed := view[key]
+	log.records = append(log.records, undoRecord{Key: key, Value: old, Existed: existed, Written: written})
+	view[key] = value
+}
+
+func (log *undoLog) savepoint(name string) {
+	log.savepoints = append(log.savepoints, savepoint{Name: name, Pos: len(log.records)})
+}
+
+// rollbackTo undoes the writes made after the savepoint name, returning the
+// records it applied in the order it applied them.
+func (log *undoLog) rollbackTo(view map[string][]byte, name string) ([]undoRecord, error) {
+	i := len(log.savepoints) - 1
+	for ; i >= 0; i-- {
+		if log.savepoints[i].Name == name {
+			break
+		}
+	}
+	if i < 0 {
+		return nil, ErrNoSavepoint
+	}
+
+	pos := log.savepoints[i].Pos
+	undone := make([]undoRecord, 0, len(log.records)-pos)
+	for j := len(log.records) - 1; j >= pos; j-- {
+		rec := log.records[j]
+		if rec.Existed {
+			view[rec.Key] = rec.Value
+		} else {
+			delete(view, rec.Key)
+		}
+		undone = append(undone, rec)
+	}
+	log.records = log.records[:pos]
+	log.savepoints = log.savepoints[:i+1]
+	return undone, nil
+}
@@ -0,0 +1,83 @@
+package transaction
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/Al0ha0e/skv/storage"
+)
+
+// PrefixEnd returns the first key after every key starting with prefix, or
+// nil when there is none.
+func PrefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+func inRange(key []byte, start []byte, end []byte) bool {
+	return bytes.Compare(key, start) >= 0 && (end == nil || bytes.Compare(key, end) < 0)
+}
+
+// mergeView overlays the entries of a transaction's View falling in
+// [start, end) on the committed pairs kvs. Deleted keys are dropped and the
+// result is ordered by key.
+func mergeView(kvs []storage.KV, view map[string][]byte, start []byte, end []byte) []storage.KV {
+	merged := make(map[string][]byte, len(kvs))
+	for _, kv := range kvs {
+		merged[string(kv.Key)] = kv.Value
+	}
+	for k, v := range view {
+		if inRange([]byte(k), start, end) {
+			merged[k] = v
+		}
+	}
+
+	ret := make([]storage.KV, 0, len(merged))
+	for k, v := range merged {
+		if v != nil {
+			ret = append(ret, storage.KV{Key: []byte(k), Value: v})
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return bytes.Compare(ret[i].Key, ret[j].Key) < 0
+	})
+	return ret
+}
+
+// firstPairs returns the first limit of kvs, all of them for a limit of 0.
+func firstPairs(kvs []storage.KV, limit int) []storage.KV {
+	if limit > 0 && len(kvs) > limit {
+		return kvs[:limit]
+	}
+	return kvs
+}
+
+// scanMerged reads [start, end) with read, overlaying view on the committed
+// pairs it returns, until limit pairs are found or the range is done. The
+// committed pairs are read limit at a time, as the view may hide any of
+// them, and all at once for a limit of 0.
+func scanMerged(read func(start []byte, end []byte, limit int) ([]storage.KV, error), view map[string][]byte, start []byte, end []byte, limit int) ([]storage.KV, error) {
+	ret := make([]storage.KV, 0)
+	for {
+		kvs, err := read(start, end, limit)
+		if err != nil {
+			return nil, err
+		}
+		// past the last key of a full batch, there may be more to read
+		bound, full := end, limit > 0 && len(kvs) == limit
+		if full {
+			bound = append(append([]byte{}, kvs[len(kvs)-1].Key...), 0)
+		}
+		ret = append(ret, mergeView(kvs, view, start, bound)...)
+		if !full || len(ret) >= limit {
+			return firstPairs(ret, limit), nil
+		}
+		start = bound
+	}
+}
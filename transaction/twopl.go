@@ -2,129 +2,165 @@ package transaction
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
-	"errors"
-	"sync"
+	"time"
 
 	"github.com/Al0ha0e/skv/storage"
 )
 
-type LockInfo struct {
-	Shared bool
-	Cnt    int
+type TwoPLInstance struct {
+	ID        TxID
+	TS        uint64
+	LM        *LockManager
+	Store     storage.Storage
+	View      map[string][]byte
+	Locks     map[string]bool // key -> held in shared mode
+	State     TxState
+	Isolation IsolationLevel
+	Deadline  time.Time
+	undo      undoLog
+	log       txLog
+	Hooks
 }
 
-func MakeLockInfo(shared bool) *LockInfo {
-	return &LockInfo{
-		Shared: shared,
-		Cnt:    1,
-	}
+func (lm *LockManager) MakeTwoPLInstance(store storage.Storage) *TwoPLInstance {
+	return lm.makeTwoPLInstance(store, lm.Begin())
 }
 
-type LockManager struct {
-	Locks map[string]*LockInfo
-	latch sync.Mutex
+func (lm *LockManager) MakeTwoPLInstanceAt(store storage.Storage, ts uint64) *TwoPLInstance {
+	return lm.makeTwoPLInstance(store, lm.BeginAt(ts))
 }
 
-func MakeLockManager() *LockManager {
-	return &LockManager{
-		Locks: make(map[string]*LockInfo),
+func (lm *LockManager) makeTwoPLInstance(store storage.Storage, id TxID) *TwoPLInstance {
+	ret := &TwoPLInstance{
+		ID:    id,
+		TS:    lm.TS(id),
+		LM:    lm,
+		Store: store,
+		View:  make(map[string][]byte),
+		Locks: make(map[string]bool),
+		State: TxStateRunning,
+		log:   txLog{store: store, id: id},
+	}
+	if lm.TxTimeout > 0 {
+		ret.Deadline = time.Now().Add(lm.TxTimeout)
 	}
+	return ret
 }
 
-func (lm *LockManager) GetLockInfo(key string) *LockInfo {
-	lm.latch.Lock()
-	defer lm.latch.Unlock()
-	return lm.Locks[key]
+func (twopl *TwoPLInstance) unlockAllLocks() {
+	for key := range twopl.Locks {
+		twopl.LM.Unlock(twopl.ID, key)
+	}
+	twopl.LM.UnlockRanges(twopl.ID)
 }
 
-func (lm *LockManager) Lock(key string, shared bool) bool {
-	lm.latch.Lock()
-	defer lm.latch.Unlock()
-	// defer fmt.Println(lm.Locks[key])
-
-	info, has := lm.Locks[key]
-	if has {
-		if shared && info.Shared {
-			info.Cnt += 1
-		} else {
-			return false
-		}
-	} else {
-		lm.Locks[key] = MakeLockInfo(shared)
+func (twopl *TwoPLInstance) abort() {
+	twopl.log.abort()
+	twopl.unlockAllLocks()
+	twopl.LM.End(twopl.ID)
+	twopl.State = TxStateAborted
+	//TODO
+}
+
+func (twopl *TwoPLInstance) check(ctx context.Context) error {
+	if twopl.State != TxStateRunning {
+		return ErrNotRunning
+	}
+	if err := ctx.Err(); err != nil {
+		twopl.abort()
+		return err
+	}
+	if !twopl.Deadline.IsZero() && !time.Now().Before(twopl.Deadline) {
+		twopl.abort()
+		return ErrTxTimeout
 	}
-	return true
+	if twopl.LM.Wounded(twopl.ID) {
+		// its locks are gone already
+		twopl.abort()
+		return ErrWounded
+	}
+	return nil
 }
 
-func (lm *LockManager) Unlock(key string) {
-	lm.latch.Lock()
-	defer lm.latch.Unlock()
+// lock acquires key in the requested mode, upgrading a shared lock the
+// transaction already holds when an exclusive one is asked for.
+func (twopl *TwoPLInstance) lock(ctx context.Context, key string, shared bool) error {
+	held, has := twopl.Locks[key]
+	if has && (shared || !held) {
+		return nil
+	}
 
-	info, has := lm.Locks[key]
-	if has {
-		info.Cnt -= 1
-		if info.Cnt == 0 {
-			delete(lm.Locks, key)
+	err := twopl.acquire(ctx, func(ctx context.Context) error {
+		if has {
+			return twopl.LM.Upgrade(ctx, twopl.ID, key)
 		}
+		return twopl.LM.Lock(ctx, twopl.ID, key, shared)
+	})
+	if err != nil {
+		return err
 	}
+	twopl.Locks[key] = shared
+	return nil
 }
 
-func (lm *LockManager) Upgrade(key string) bool {
-	lm.latch.Lock()
-	defer lm.latch.Unlock()
+// acquire runs a lock request bounded by the transaction deadline, aborting
+// the transaction if the lock cannot be had.
+func (twopl *TwoPLInstance) acquire(ctx context.Context, request func(ctx context.Context) error) error {
+	if !twopl.Deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, twopl.Deadline)
+		defer cancel()
+	}
 
-	info, has := lm.Locks[key]
-	if has && info.Cnt == 1 {
-		info.Shared = false
-		return true
+	err := request(ctx)
+	if err == context.DeadlineExceeded && !twopl.Deadline.IsZero() && !time.Now().Before(twopl.Deadline) {
+		err = ErrTxTimeout
 	}
-	return false
+	if err != nil {
+		twopl.abort()
+	}
+	return err
 }
 
-type TwoPLInstance struct {
-	LM    *LockManager
-	Store storage.Storage
-	View  map[string][]byte
-	State TxState
-}
+// LockPrefix locks every key under prefix, shared for reading or exclusive
+// for bulk writes, so the keys themselves need no locks of their own.
+func (twopl *TwoPLInstance) LockPrefix(ctx context.Context, prefix string, shared bool) (err error) {
+	if err = twopl.check(ctx); err != nil {
+		return err
+	}
 
-func (lm *LockManager) MakeTwoPLInstance(store storage.Storage) *TwoPLInstance {
-	return &TwoPLInstance{
-		LM:    lm,
-		Store: store,
-		View:  make(map[string][]byte),
-		State: TxStateRunning,
+	mode := LockModeX
+	if shared {
+		mode = LockModeS
 	}
+	return twopl.acquire(ctx, func(ctx context.Context) error {
+		return twopl.LM.LockPrefix(ctx, twopl.ID, prefix, mode)
+	})
 }
 
-func (twopl *TwoPLInstance) unlockAllLocks() {
-	for key := range twopl.View {
-		twopl.LM.Unlock(key)
+func (twopl *TwoPLInstance) read(ctx context.Context, key []byte, shared bool) (value []byte, err error) {
+	if err = twopl.check(ctx); err != nil {
+		return nil, err
 	}
-}
 
-func (twopl *TwoPLInstance) abort() {
-	twopl.unlockAllLocks()
-	twopl.State = TxStateAborted
-	//TODO
-}
+	skey := string(key)
+	_, held := twopl.Locks[skey]
+	if shared && !held && twopl.Isolation == IsolationReadCommitted {
+		return twopl.readCommitted(ctx, key, skey)
+	}
 
-func (twopl *TwoPLInstance) Get(key []byte) (value []byte, err error) {
-	if twopl.State != TxStateRunning {
-		return nil, errors.New("tx not running")
+	err = twopl.lock(ctx, skey, shared)
+	if err != nil {
+		return nil, err
 	}
 
-	skey := string(key)
 	value, ok := twopl.View[skey]
 	if ok {
 		return value, nil
 	}
 
-	if !twopl.LM.Lock(skey, true) { //No Wait
-		twopl.abort()
-		return nil, errors.New("abort")
-	}
-
 	twopl.Store.Lock()
 	value, err = twopl.Store.Get(key)
 	twopl.Store.Unlock()
@@ -136,88 +172,131 @@ func (twopl *TwoPLInstance) Get(key []byte) (value []byte, err error) {
 	return value, nil
 }
 
-func (twopl *TwoPLInstance) GetForUpdate(key []byte) (value []byte, err error) {
-	if twopl.State != TxStateRunning {
-		return nil, errors.New("tx not running")
-	}
-
-	skey := string(key)
-	value, ok := twopl.View[skey]
-	if ok {
-		return value, nil
+// readCommitted only holds the shared lock for the duration of the read, so
+// the value is not cached and a later read may observe a newer commit.
+func (twopl *TwoPLInstance) readCommitted(ctx context.Context, key []byte, skey string) (value []byte, err error) {
+	err = twopl.lock(ctx, skey, true)
+	if err != nil {
+		return nil, err
 	}
 
-	if !twopl.LM.Lock(skey, false) { //No Wait
-		twopl.abort()
-		return nil, errors.New("abort")
-	}
 	twopl.Store.Lock()
 	value, err = twopl.Store.Get(key)
 	twopl.Store.Unlock()
+
+	twopl.LM.Unlock(twopl.ID, skey)
+	delete(twopl.Locks, skey)
 	if err != nil {
 		twopl.abort()
 		return nil, err
 	}
-	twopl.View[skey] = value
 	return value, nil
 }
 
-func (twopl *TwoPLInstance) Put(key []byte, value []byte) (err error) {
-	if twopl.State != TxStateRunning {
-		return errors.New("tx not running")
+func (twopl *TwoPLInstance) Get(ctx context.Context, key []byte) (value []byte, err error) {
+	return twopl.read(ctx, key, true)
+}
+
+func (twopl *TwoPLInstance) GetForUpdate(ctx context.Context, key []byte) (value []byte, err error) {
+	return twopl.read(ctx, key, false)
+}
+
+func (twopl *TwoPLInstance) Put(ctx context.Context, key []byte, value []byte) (err error) {
+	if err = twopl.check(ctx); err != nil {
+		return err
 	}
 
 	skey := string(key)
-	_, ok := twopl.View[skey]
+	err = twopl.lock(ctx, skey, false)
+	if err != nil {
+		return err
+	}
 
-	if ok {
-		if twopl.LM.GetLockInfo(skey).Shared {
-			if !twopl.LM.Upgrade(skey) {
-				twopl.abort()
-				return errors.New("abort")
-			}
+	return twopl.write(skey, value)
+}
+
+// write changes key in the View, logging the change ahead of the commit.
+func (twopl *TwoPLInstance) write(key string, value []byte) error {
+	twopl.undo.write(twopl.View, key, value, twopl.log.written[key])
+	if err := twopl.log.write(key, value); err != nil {
+		twopl.abort()
+		return err
+	}
+	return nil
+}
+
+func (twopl *TwoPLInstance) PutBatch(ctx context.Context, kvs []storage.KV) (err error) {
+	for _, kv := range kvs {
+		if err = twopl.Put(ctx, kv.Key, kv.Value); err != nil {
+			return err
 		}
-	} else {
-		if !twopl.LM.Lock(skey, false) { //No Wait
-			twopl.abort()
-			return errors.New("abort")
+	}
+	return nil
+}
+
+// Scan returns the keys in [start, end) as the transaction sees them. Under
+// serializable isolation a shared range lock keeps other transactions from
+// inserting into the range; repeatable read only locks the keys it returns,
+// and read committed locks nothing, as the store only holds committed data.
+func (twopl *TwoPLInstance) Scan(ctx context.Context, start []byte, end []byte) (kvs []storage.KV, err error) {
+	return twopl.ScanLimit(ctx, start, end, 0)
+}
+
+// ScanLimit locks the whole range under serializable isolation, as Scan
+// does, but only reads the pairs it returns.
+func (twopl *TwoPLInstance) ScanLimit(ctx context.Context, start []byte, end []byte, limit int) (kvs []storage.KV, err error) {
+	if err = twopl.check(ctx); err != nil {
+		return nil, err
+	}
+
+	if twopl.Isolation == IsolationSerializable {
+		err = twopl.acquire(ctx, func(ctx context.Context) error {
+			return twopl.LM.LockRange(ctx, twopl.ID, string(start), string(end), true)
+		})
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	twopl.View[skey] = value
-	return nil
+	read := func(start []byte, end []byte, limit int) ([]storage.KV, error) {
+		return twopl.scanStore(ctx, start, end, limit)
+	}
+	return scanMerged(read, twopl.View, start, end, limit)
 }
 
-func (twopl *TwoPLInstance) Increase32(key []byte, inc int32) (err error) {
-	if twopl.State != TxStateRunning {
-		return errors.New("tx not running")
+// scanStore reads the first limit committed pairs of [start, end).
+func (twopl *TwoPLInstance) scanStore(ctx context.Context, start []byte, end []byte, limit int) (kvs []storage.KV, err error) {
+	twopl.Store.Lock()
+	kvs, err = twopl.Store.Scan(start, end, limit)
+	twopl.Store.Unlock()
+	if err != nil {
+		twopl.abort()
+		return nil, err
 	}
-	skey := string(key)
-	value, ok := twopl.View[skey]
-	ivalue := int32(0)
 
-	if ok {
-		if twopl.LM.GetLockInfo(skey).Shared {
-			if !twopl.LM.Upgrade(skey) {
-				twopl.abort()
-				return errors.New("abort")
+	if twopl.Isolation == IsolationRepeatableRead {
+		// the key may have changed before its lock was granted
+		for i := range kvs {
+			kvs[i].Value, err = twopl.read(ctx, kvs[i].Key, true)
+			if err != nil {
+				return nil, err
 			}
 		}
-	} else {
-		if !twopl.LM.Lock(skey, false) { //No Wait
-			twopl.abort()
-			return errors.New("abort")
-		}
-		twopl.Store.Lock()
-		value, err = twopl.Store.Get(key)
-		twopl.Store.Unlock()
-		if err != nil {
-			twopl.abort()
-			return err
-		}
-		twopl.View[skey] = value
 	}
+	return kvs, nil
+}
+
+func (twopl *TwoPLInstance) PrefixScan(ctx context.Context, prefix []byte) (kvs []storage.KV, err error) {
+	return twopl.Scan(ctx, prefix, PrefixEnd(prefix))
+}
 
+func (twopl *TwoPLInstance) Increase32(ctx context.Context, key []byte, inc int32) (err error) {
+	value, err := twopl.GetForUpdate(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	ivalue := int32(0)
 	if value != nil {
 		err = binary.Read(bytes.NewBuffer(value), binary.BigEndian, &ivalue)
 		if err != nil {
@@ -228,44 +307,99 @@ func (twopl *TwoPLInstance) Increase32(key []byte, inc int32) (err error) {
 
 	buf := &bytes.Buffer{}
 	binary.Write(buf, binary.BigEndian, ivalue+inc)
-	twopl.View[skey] = buf.Bytes()
+	return twopl.write(string(key), buf.Bytes())
+}
+
+func (twopl *TwoPLInstance) Delete(ctx context.Context, key []byte) (err error) {
+	return twopl.Put(ctx, key, nil)
+}
+
+func (twopl *TwoPLInstance) Savepoint(name string) (err error) {
+	if twopl.State != TxStateRunning {
+		return ErrNotRunning
+	}
+	twopl.undo.savepoint(name)
 	return nil
 }
 
-func (twopl *TwoPLInstance) Delete(key []byte) (err error) {
-	return twopl.Put(key, nil)
+func (twopl *TwoPLInstance) RollbackTo(name string) (err error) {
+	if twopl.State != TxStateRunning {
+		return ErrNotRunning
+	}
+	undone, err := twopl.undo.rollbackTo(twopl.View, name)
+	if err != nil {
+		return err
+	}
+	if err = twopl.log.restore(undone); err != nil {
+		twopl.abort()
+	}
+	return err
 }
 
 func (twopl *TwoPLInstance) Commit() (err error) {
 
 	if twopl.State != TxStateRunning {
-		return errors.New("tx not running")
+		return ErrNotRunning
 	}
 
-	kvs := make([]storage.KV, 0)
+	if !twopl.Deadline.IsZero() && !time.Now().Before(twopl.Deadline) {
+		twopl.abort()
+		return ErrTxTimeout
+	}
 
-	for k, v := range twopl.View {
-		if !twopl.LM.GetLockInfo(k).Shared {
-			kvs = append(kvs, storage.KV{Key: []byte(k), Value: v})
+	err = twopl.LM.Hooks.preCommit(twopl, twopl.writes())
+	if err == nil {
+		err = twopl.Hooks.preCommit(twopl, twopl.writes())
+	}
+	if err != nil {
+		// a hook's own write may have aborted the transaction already
+		if twopl.State == TxStateRunning {
+			twopl.abort()
 		}
+		return err
 	}
 
-	twopl.Store.Lock()
-	err = twopl.Store.PutBatch(kvs)
-	twopl.Store.Unlock()
+	if err = twopl.LM.seal(twopl.ID); err != nil {
+		twopl.abort()
+		return err
+	}
+
+	kvs := twopl.writes()
+	keys := make([][]byte, 0, len(kvs))
+	for _, kv := range kvs {
+		keys = append(keys, kv.Key)
+	}
+
+	write := func(ts uint64) error {
+		twopl.Store.Lock()
+		defer twopl.Store.Unlock()
+		return twopl.log.commit(ts, kvs)
+	}
+	if twopl.LM.Versions != nil {
+		err = twopl.LM.Versions.Install(keys, write)
+	} else {
+		err = write(0)
+	}
 	if err != nil {
 		twopl.abort()
 		return err
 	}
 
 	twopl.unlockAllLocks()
+	twopl.LM.End(twopl.ID)
 	twopl.State = TxStateCommitted
+	twopl.LM.Hooks.postCommit(kvs)
+	twopl.Hooks.postCommit(kvs)
 	return nil
 }
 
+func (twopl *TwoPLInstance) writes() []storage.KV {
+	return twopl.log.writes(twopl.View)
+}
+
 func (twopl *TwoPLInstance) Abort() (err error) {
 	if twopl.State != TxStateRunning {
-		return errors.New("tx not running")
+		return ErrNotRunning
 	}
 	twopl.abort()
 	return nil
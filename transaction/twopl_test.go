@@ -1,24 +1,137 @@
 package transaction
 
 import (
+	"context"
+	"errors"
 	"testing"
+	"time"
 
 	"github.com/Al0ha0e/skv/storage"
 )
 
+var ctx = context.Background()
+
 func TestLock(t *testing.T) {
-	lm := MakeLockManager()
+	lm := MakeLockManager(LockPolicyNoWait)
 	keys := []string{"aaa", "bbb"}
-	ok := lm.Lock(keys[0], true)
-	t.Log("---", ok, lm.Locks[keys[0]])
-	ok = lm.Lock(keys[0], false)
-	t.Log("---", ok, lm.Locks[keys[0]])
-	ok = lm.Lock(keys[0], true)
-	t.Log("---", ok, lm.Locks[keys[0]])
-	lm.Unlock(keys[0])
-	t.Log("---", ok, lm.Locks[keys[0]])
-	lm.Unlock(keys[0])
-	t.Log("---", ok, lm.Locks[keys[0]])
+	err := lm.Lock(ctx, 1, keys[0], true)
+	t.Log("---", err, lm.Locks[keys[0]])
+	err = lm.Lock(ctx, 2, keys[0], false)
+	t.Log("---", err, lm.Locks[keys[0]])
+	if err != ErrLockConflict {
+		t.Error("expected conflict", err)
+	}
+	err = lm.Lock(ctx, 3, keys[0], true)
+	t.Log("---", err, lm.Locks[keys[0]])
+	lm.Unlock(1, keys[0])
+	t.Log("---", err, lm.Locks[keys[0]])
+	lm.Unlock(3, keys[0])
+	t.Log("---", err, lm.Locks[keys[0]])
+	if lm.Locks[keys[0]] != nil {
+		t.Error("lock not released")
+	}
+}
+
+func TestLockWait(t *testing.T) {
+	lm := MakeLockManager(LockPolicyDetect)
+	if err := lm.Lock(ctx, 1, "aaa", false); err != nil {
+		t.Fatal(err)
+	}
+
+	ch := make(chan error, 1)
+	go func() {
+		ch <- lm.Lock(ctx, 2, "aaa", true)
+	}()
+
+	select {
+	case err := <-ch:
+		t.Fatal("granted while exclusively held", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	lm.Unlock(1, "aaa")
+	if err := <-ch; err != nil {
+		t.Fatal(err)
+	}
+	if !lm.GetLockInfo("aaa").Holders[2] {
+		t.Error("waiter not granted")
+	}
+}
+
+func TestDeadlockDetect(t *testing.T) {
+	lm := MakeLockManager(LockPolicyDetect)
+	lm.Lock(ctx, 1, "aaa", false)
+	lm.Lock(ctx, 2, "bbb", false)
+
+	ch := make(chan error, 1)
+	go func() {
+		ch <- lm.Lock(ctx, 1, "bbb", false)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	err := lm.Lock(ctx, 2, "aaa", false)
+	if err != ErrDeadlock {
+		t.Fatal("expected younger tx to be the victim", err)
+	}
+	lm.Unlock(2, "bbb")
+	if err = <-ch; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeadlockVictimByAge(t *testing.T) {
+	lm := MakeLockManager(LockPolicyDetect)
+	lm.End(lm.Begin())
+	younger := lm.Begin()
+	// restarted after the younger one began, but keeping its first start
+	restarted := lm.BeginAt(1)
+	lm.Lock(ctx, restarted, "aaa", false)
+	lm.Lock(ctx, younger, "bbb", false)
+
+	ch := make(chan error, 1)
+	go func() {
+		ch <- lm.Lock(ctx, younger, "aaa", false)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		lm.Unlock(younger, "bbb")
+	}()
+	if err := lm.Lock(ctx, restarted, "bbb", false); err != nil {
+		t.Fatal("older transaction chosen as the victim", err)
+	}
+	if err := <-ch; err != ErrDeadlock {
+		t.Fatal("expected the younger transaction to be the victim", err)
+	}
+}
+
+func TestTwoPLWait(t *testing.T) {
+	lm := MakeLockManager(LockPolicyDetect)
+	store := storage.MakeNaiveStorage()
+
+	tx1 := lm.MakeTwoPLInstance(store)
+	tx2 := lm.MakeTwoPLInstance(store)
+	tx1.Put(ctx, []byte{1}, []byte{11})
+	tx2.Put(ctx, []byte{2}, []byte{22})
+
+	ch := make(chan error, 1)
+	go func() {
+		_, err := tx1.Get(ctx, []byte{2})
+		ch <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	_, err := tx2.Get(ctx, []byte{1})
+	if err != ErrDeadlock || tx2.State != TxStateAborted {
+		t.Fatal("expected tx2 to be aborted", err)
+	}
+	if err = <-ch; err != nil {
+		t.Fatal(err)
+	}
+	if err = tx1.Commit(); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestPut(t *testing.T) {
@@ -30,35 +143,675 @@ func TestPut(t *testing.T) {
 	t.Log(sb[2] == sb2[2])
 	t.Log("----------")
 
-	lm := MakeLockManager()
+	lm := MakeLockManager(LockPolicyNoWait)
 	store := storage.MakeNaiveStorage()
 	instance := lm.MakeTwoPLInstance(store)
-	instance.Put([]byte{1, 2, 3}, []byte{11, 22, 33})
-	t.Log(instance.Get([]byte{1, 2, 3}))
-	t.Log(instance.Get([]byte{4, 5, 6}))
+	instance.Put(ctx, []byte{1, 2, 3}, []byte{11, 22, 33})
+	t.Log(instance.Get(ctx, []byte{1, 2, 3}))
+	t.Log(instance.Get(ctx, []byte{4, 5, 6}))
 	instance.Commit()
 	instance2 := lm.MakeTwoPLInstance(store)
-	t.Log(instance2.Get([]byte{1, 2, 3}))
-	t.Log(instance2.Put([]byte{1, 2, 3}, []byte{44, 55, 66}))
-	t.Log(instance2.Get([]byte{1, 2, 3}))
+	t.Log(instance2.Get(ctx, []byte{1, 2, 3}))
+	t.Log(instance2.Put(ctx, []byte{1, 2, 3}, []byte{44, 55, 66}))
+	t.Log(instance2.Get(ctx, []byte{1, 2, 3}))
 	instance3 := lm.MakeTwoPLInstance(store)
-	t.Log(instance3.Get([]byte{1, 2, 3}))
-	t.Log(instance3.Put([]byte{1, 2, 3}, []byte{77, 88, 99}))
+	t.Log(instance3.Get(ctx, []byte{1, 2, 3}))
+	t.Log(instance3.Put(ctx, []byte{1, 2, 3}, []byte{77, 88, 99}))
 }
 
 func TestDelete(t *testing.T) {
-	lm := MakeLockManager()
+	lm := MakeLockManager(LockPolicyNoWait)
 	store := storage.MakeNaiveStorage()
 	instance := lm.MakeTwoPLInstance(store)
-	instance.Put([]byte{1, 2, 3}, []byte{11, 22, 33})
-	t.Log(instance.Get([]byte{1, 2, 3}))
+	instance.Put(ctx, []byte{1, 2, 3}, []byte{11, 22, 33})
+	t.Log(instance.Get(ctx, []byte{1, 2, 3}))
 	instance.Commit()
 	instance2 := lm.MakeTwoPLInstance(store)
-	t.Log(instance2.Get([]byte{1, 2, 3}))
-	t.Log(instance2.Delete([]byte{1, 2, 3}))
-	t.Log(instance2.Get([]byte{1, 2, 3}))
+	t.Log(instance2.Get(ctx, []byte{1, 2, 3}))
+	t.Log(instance2.Delete(ctx, []byte{1, 2, 3}))
+	t.Log(instance2.Get(ctx, []byte{1, 2, 3}))
 	instance2.Commit()
 	instance3 := lm.MakeTwoPLInstance(store)
-	t.Log(instance3.Get([]byte{1, 2, 3}))
+	t.Log(instance3.Get(ctx, []byte{1, 2, 3}))
+
+}
+
+func TestWaitDie(t *testing.T) {
+	lm := MakeLockManager(LockPolicyWaitDie)
+	older := lm.Begin()
+	younger := lm.Begin()
+
+	lm.Lock(ctx, older, "aaa", false)
+	if err := lm.Lock(ctx, younger, "aaa", true); err != ErrDie {
+		t.Fatal("younger requester should die", err)
+	}
+
+	lm.Unlock(older, "aaa")
+	lm.Lock(ctx, younger, "aaa", false)
+	ch := make(chan error, 1)
+	go func() {
+		ch <- lm.Lock(ctx, older, "aaa", false)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	lm.Unlock(younger, "aaa")
+	if err := <-ch; err != nil {
+		t.Fatal("older requester should wait", err)
+	}
+}
+
+func TestWoundWait(t *testing.T) {
+	lm := MakeLockManager(LockPolicyWoundWait)
+	store := storage.MakeNaiveStorage()
+
+	older := lm.MakeTwoPLInstance(store)
+	younger := lm.MakeTwoPLInstance(store)
+	younger.Put(ctx, []byte{1}, []byte{11})
+
+	ch := make(chan error, 1)
+	go func() {
+		ch <- older.Put(ctx, []byte{1}, []byte{22})
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	if err := younger.Commit(); err != ErrWounded {
+		t.Fatal("younger holder should be wounded", err)
+	}
+	if err := <-ch; err != nil {
+		t.Fatal(err)
+	}
+	if err := older.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	v, _ := store.Get([]byte{1})
+	if v[0] != 22 {
+		t.Error("bad value", v)
+	}
+
+	restarted := lm.MakeTwoPLInstanceAt(store, older.TS)
+	if restarted.TS != older.TS {
+		t.Error("restart lost its timestamp", restarted.TS)
+	}
+	restarted.Abort()
+}
+
+func TestWoundReleasesLocks(t *testing.T) {
+	lm := MakeLockManager(LockPolicyWoundWait)
+	store := storage.MakeNaiveStorage()
+
+	older := lm.MakeTwoPLInstance(store)
+	younger := lm.MakeTwoPLInstance(store)
+	younger.Put(ctx, []byte{1}, []byte{11})
+	younger.Put(ctx, []byte{2}, []byte{11})
+
+	// the older transaction gets the lock without the younger one doing
+	// anything, and keeps it
+	done := make(chan error, 1)
+	go func() {
+		done <- older.Put(ctx, []byte{1}, []byte{22})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("older transaction waits for the wounded one")
+	}
+	if _, err := younger.Get(ctx, []byte{1}); err != ErrWounded {
+		t.Fatal("wounded transaction still runs", err)
+	}
+	if info := lm.GetLockInfo("\x02"); info != nil {
+		t.Fatal("wounded transaction kept its locks", info.Holders)
+	}
+	if err := older.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a committing transaction keeps its locks until its writes are in
+	older = lm.MakeTwoPLInstance(store)
+	younger = lm.MakeTwoPLInstance(store)
+	younger.Put(ctx, []byte{3}, []byte{11})
+	lm.seal(younger.ID)
+	go func() {
+		done <- older.Put(ctx, []byte{3}, []byte{22})
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if lm.Wounded(younger.ID) {
+		t.Fatal("committing transaction wounded")
+	}
+	if err := younger.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	older.Commit()
+}
+
+func TestLockTimeout(t *testing.T) {
+	lm := MakeLockManager(LockPolicyDetect)
+	lm.LockTimeout = 20 * time.Millisecond
+	lm.Lock(ctx, 1, "aaa", false)
+
+	if err := lm.Lock(ctx, 2, "aaa", false); err != ErrLockTimeout {
+		t.Fatal("expected lock timeout", err)
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	lm.LockTimeout = 0
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	if err := lm.Lock(cctx, 3, "aaa", true); err != context.Canceled {
+		t.Fatal("expected cancellation", err)
+	}
+
+	lm.Unlock(1, "aaa")
+	if lm.GetLockInfo("aaa") != nil {
+		t.Error("abandoned requests left in queue")
+	}
+}
+
+func TestTxTimeout(t *testing.T) {
+	lm := MakeLockManager(LockPolicyDetect)
+	lm.TxTimeout = 30 * time.Millisecond
+	store := storage.MakeNaiveStorage()
+
+	tx1 := lm.MakeTwoPLInstance(store)
+	tx2 := lm.MakeTwoPLInstance(store)
+	tx1.Put(ctx, []byte{1}, []byte{11})
+
+	if _, err := tx2.Get(ctx, []byte{1}); err != ErrTxTimeout {
+		t.Fatal("expected tx timeout while waiting", err)
+	}
+	if err := tx1.Commit(); err != ErrTxTimeout {
+		t.Fatal("expected expired tx to abort at commit", err)
+	}
+	if lm.GetLockInfo(string([]byte{1})) != nil {
+		t.Error("locks not released")
+	}
+}
+
+func TestFairQueue(t *testing.T) {
+	lm := MakeLockManager(LockPolicyDetect)
+	lm.Lock(ctx, 1, "aaa", true)
+
+	writer := make(chan error, 1)
+	go func() {
+		writer <- lm.Lock(ctx, 2, "aaa", false)
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	reader := make(chan error, 1)
+	go func() {
+		reader <- lm.Lock(ctx, 3, "aaa", true)
+	}()
+
+	select {
+	case <-reader:
+		t.Fatal("reader overtook a queued writer")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	lm.Unlock(1, "aaa")
+	if err := <-writer; err != nil {
+		t.Fatal(err)
+	}
+	lm.Unlock(2, "aaa")
+	if err := <-reader; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpgradePriority(t *testing.T) {
+	lm := MakeLockManager(LockPolicyDetect)
+	lm.Lock(ctx, 1, "aaa", true)
+	lm.Lock(ctx, 2, "aaa", true)
+
+	writer := make(chan error, 1)
+	go func() {
+		writer <- lm.Lock(ctx, 3, "aaa", false)
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	upgrade := make(chan error, 1)
+	go func() {
+		upgrade <- lm.Upgrade(ctx, 1, "aaa")
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	lm.Unlock(2, "aaa")
+	if err := <-upgrade; err != nil {
+		t.Fatal(err)
+	}
+	if info := lm.GetLockInfo("aaa"); info.Shared || !info.Holders[1] {
+		t.Fatal("upgrade not granted before queued writer", info)
+	}
+	lm.Unlock(1, "aaa")
+	if err := <-writer; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpgradeDeadlock(t *testing.T) {
+	lm := MakeLockManager(LockPolicyDetect)
+	lm.Lock(ctx, 1, "aaa", true)
+	lm.Lock(ctx, 2, "aaa", true)
+
+	ch := make(chan error, 1)
+	go func() {
+		ch <- lm.Upgrade(ctx, 1, "aaa")
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	if err := lm.Upgrade(ctx, 2, "aaa"); err != ErrDeadlock {
+		t.Fatal("expected conflicting upgrades to deadlock", err)
+	}
+	lm.Unlock(2, "aaa")
+	if err := <-ch; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSavepoint(t *testing.T) {
+	lm := MakeLockManager(LockPolicyNoWait)
+	store := storage.MakeNaiveStorage()
+	store.Put([]byte{1}, []byte{11})
+
+	tx := lm.MakeTwoPLInstance(store)
+	tx.Put(ctx, []byte{1}, []byte{22})
+	tx.Savepoint("sp1")
+	tx.Put(ctx, []byte{1}, []byte{33})
+	tx.Put(ctx, []byte{2}, []byte{44})
+	tx.Savepoint("sp2")
+	tx.Delete(ctx, []byte{1})
+
+	if err := tx.RollbackTo("sp1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.RollbackTo("sp2"); err != ErrNoSavepoint {
+		t.Fatal("later savepoint survived a rollback", err)
+	}
+	v, _ := tx.Get(ctx, []byte{1})
+	if v[0] != 22 {
+		t.Fatal("bad value after rollback", v)
+	}
+	if _, held := tx.Locks[string([]byte{2})]; !held {
+		t.Fatal("rollback released a lock")
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	v, _ = store.Get([]byte{1})
+	if v[0] != 22 {
+		t.Error("bad value", v)
+	}
+	if v, _ = store.Get([]byte{2}); v != nil {
+		t.Error("rolled back insert was committed", v)
+	}
+}
+
+func TestWriteSet(t *testing.T) {
+	lm, mvcc, store := makeTestManagers()
+	store.Put([]byte{1}, []byte{11})
+	store.Put([]byte{2}, []byte{22})
+
+	begin := []func() Transaction{
+		func() Transaction { return lm.MakeTwoPLInstance(store) },
+		func() Transaction { snap, _ := mvcc.MakeMVCCInstance(store); return snap },
+	}
+	for _, makeTx := range begin {
+		tx := makeTx()
+		tx.GetForUpdate(ctx, []byte{1})
+		tx.GetForUpdate(ctx, []byte{2})
+		tx.Put(ctx, []byte{3}, []byte{33})
+		tx.Savepoint("sp")
+		tx.Put(ctx, []byte{2}, []byte{44})
+		tx.RollbackTo("sp")
+
+		var kvs []storage.KV
+		switch tx := tx.(type) {
+		case *TwoPLInstance:
+			kvs = tx.writes()
+		case *MVCCInstance:
+			kvs = tx.writes()
+		}
+		if len(kvs) != 1 || kvs[0].Key[0] != 3 {
+			t.Errorf("%T: reads counted as writes %v", tx, kvs)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRangeLock(t *testing.T) {
+	lm := MakeLockManager(LockPolicyDetect)
+	if err := lm.LockRange(ctx, 1, "b", "d", true); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := lm.Lock(ctx, 2, "a", false); err != nil {
+		t.Fatal("key outside the range blocked", err)
+	}
+	if err := lm.Lock(ctx, 2, "c", true); err != nil {
+		t.Fatal("shared lock blocked by shared range", err)
+	}
+
+	insert := make(chan error, 1)
+	go func() {
+		insert <- lm.Lock(ctx, 3, "bb", false)
+	}()
+	select {
+	case err := <-insert:
+		t.Fatal("insert into a locked range granted", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	writer := make(chan error, 1)
+	go func() {
+		writer <- lm.LockRange(ctx, 4, "c", "", false)
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	lm.UnlockRanges(1)
+	if err := <-insert; err != nil {
+		t.Fatal(err)
+	}
+	lm.Unlock(2, "c")
+	if err := <-writer; err != nil {
+		t.Fatal(err)
+	}
+	tctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if err := lm.Lock(tctx, 2, "zzz", true); err != context.DeadlineExceeded {
+		t.Fatal("unbounded exclusive range not enforced", err)
+	}
+}
+
+func TestRangeNotStarved(t *testing.T) {
+	lm := MakeLockManager(LockPolicyDetect)
+	lm.Lock(ctx, 1, "b", true)
+
+	writer := make(chan error, 1)
+	go func() {
+		writer <- lm.LockRange(ctx, 2, "a", "c", false)
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	// a reader of a key in the range queues behind it, even though the key
+	// is only read so far
+	reader := make(chan error, 1)
+	go func() {
+		reader <- lm.Lock(ctx, 3, "b", true)
+	}()
+	select {
+	case err := <-reader:
+		t.Fatal("key request overtook a queued range", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := lm.Lock(ctx, 3, "c", true); err != nil {
+		t.Fatal("key outside the queued range blocked", err)
+	}
+
+	lm.Unlock(1, "b")
+	if err := <-writer; err != nil {
+		t.Fatal(err)
+	}
+	lm.UnlockRanges(2)
+	if err := <-reader; err != nil {
+		t.Fatal(err)
+	}
+	if keys := lm.keysIn("a", ""); len(keys) != 2 || keys[0] != "b" || keys[1] != "c" {
+		t.Fatal("bad lock index", keys)
+	}
+}
+
+func TestRangeDeadlock(t *testing.T) {
+	lm := MakeLockManager(LockPolicyDetect)
+	lm.LockRange(ctx, 1, "a", "c", true)
+	lm.LockRange(ctx, 2, "x", "z", true)
+
+	ch := make(chan error, 1)
+	go func() {
+		ch <- lm.Lock(ctx, 1, "y", false)
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	if err := lm.Lock(ctx, 2, "b", false); err != ErrDeadlock {
+		t.Fatal("expected deadlock between range readers", err)
+	}
+	lm.UnlockRanges(2)
+	if err := <-ch; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRefusedLockDropped(t *testing.T) {
+	for _, policy := range []LockPolicy{LockPolicyNoWait, LockPolicyWaitDie} {
+		lm := MakeLockManager(policy)
+		older, younger := lm.Begin(), lm.Begin()
+		if err := lm.LockRange(ctx, older, "b", "d", false); err != nil {
+			t.Fatal(err)
+		}
+		if err := lm.Lock(ctx, younger, "c", true); err == nil {
+			t.Fatal("lock inside an exclusive range granted")
+		}
+		if len(lm.Locks) != 0 || len(lm.keys) != 0 {
+			t.Error("refused lock left behind", policy, lm.Locks, lm.keys)
+		}
+	}
+}
+
+func TestIntentionLock(t *testing.T) {
+	lm := MakeLockManager(LockPolicyNoWait)
+	lm.Separator = "/"
+
+	if err := lm.Lock(ctx, 1, "t1/users/1", false); err != nil {
+		t.Fatal(err)
+	}
+	if mode := lm.Prefixes["t1/"].Holders[1]; mode != LockModeIX {
+		t.Fatal("expected IX on the enclosing prefix", mode)
+	}
+	if err := lm.LockPrefix(ctx, 2, "t1/users/", LockModeS); err != ErrLockConflict {
+		t.Fatal("S granted beside IX", err)
+	}
+	if err := lm.LockPrefix(ctx, 2, "t2/", LockModeX); err != nil {
+		t.Fatal(err)
+	}
+	if err := lm.Lock(ctx, 3, "t2/a", true); err != ErrLockConflict {
+		t.Fatal("read under an exclusive prefix granted", err)
+	}
+
+	if err := lm.LockPrefix(ctx, 1, "t1/", LockModeS); err != nil {
+		t.Fatal(err)
+	}
+	if mode := lm.Prefixes["t1/"].Holders[1]; mode != LockModeSIX {
+		t.Fatal("expected IX and S to combine into SIX", mode)
+	}
+	if err := lm.Lock(ctx, 3, "t1/users/2", true); err != nil {
+		t.Fatal("IS refused beside SIX", err)
+	}
+
+	lm.Unlock(1, "t1/users/1")
+	lm.End(1)
+	lm.End(2)
+	if err := lm.Lock(ctx, 3, "t2/a", false); err != nil {
+		t.Fatal("prefix lock not released at end", err)
+	}
+}
+
+func TestLockEscalation(t *testing.T) {
+	lm := MakeLockManager(LockPolicyNoWait)
+	lm.Separator = "/"
+	lm.EscalateAfter = 3
+
+	for _, key := range []string{"t1/a", "t1/b", "t1/c"} {
+		if err := lm.Lock(ctx, 1, key, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := lm.Lock(ctx, 1, "t1/d", false); err != nil {
+		t.Fatal(err)
+	}
+	if mode := lm.Prefixes["t1/"].Holders[1]; mode != LockModeX {
+		t.Fatal("expected escalation to X", mode)
+	}
+	if len(lm.Locks) != 0 {
+		t.Fatal("key locks kept after escalation", lm.Locks)
+	}
+	if err := lm.Lock(ctx, 1, "t1/e", false); err != nil || len(lm.Locks) != 0 {
+		t.Fatal("covered key locked again", err)
+	}
+	if err := lm.Lock(ctx, 2, "t1/a", true); err != ErrLockConflict {
+		t.Fatal("key under an escalated prefix granted", err)
+	}
+
+	lm.End(1)
+	if err := lm.Lock(ctx, 2, "t1/a", true); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"t1/b", "t1/c", "t1/d", "t1/e"} {
+		lm.Lock(ctx, 3, key, true)
+	}
+	if mode := lm.Prefixes["t1/"].Holders[3]; mode != LockModeS {
+		t.Fatal("expected escalation to S beside another reader", mode)
+	}
+}
+
+func TestPrefixBulkWrite(t *testing.T) {
+	store := storage.MakeNaiveStorage()
+	lm := MakeLockManager(LockPolicyNoWait)
+	lm.Separator = "/"
+
+	tx1 := lm.MakeTwoPLInstance(store)
+	if err := tx1.LockPrefix(ctx, "bulk/", false); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"bulk/a", "bulk/b"} {
+		if err := tx1.Put(ctx, []byte(key), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(lm.Locks) != 0 {
+		t.Fatal("bulk writes took key locks", lm.Locks)
+	}
+
+	tx2 := lm.MakeTwoPLInstance(store)
+	if _, err := tx2.Get(ctx, []byte("bulk/a")); err != ErrLockConflict {
+		t.Fatal("read under a locked prefix granted", err)
+	}
+
+	if err := tx1.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	tx3 := lm.MakeTwoPLInstance(store)
+	value, err := tx3.Get(ctx, []byte("bulk/b"))
+	if err != nil || string(value) != "v" {
+		t.Fatal("bulk write not committed", value, err)
+	}
+}
+
+func TestScan(t *testing.T) {
+	store := storage.MakeNaiveStorage()
+	store.Put([]byte("k1"), []byte{1})
+	store.Put([]byte("k2"), []byte{2})
+	store.Put([]byte("m1"), []byte{9})
+	lm := MakeLockManager(LockPolicyNoWait)
+
+	tx1 := lm.MakeTwoPLInstance(store)
+	tx1.PutBatch(ctx, []storage.KV{{Key: []byte("k3"), Value: []byte{3}}, {Key: []byte("k1"), Value: nil}})
+	kvs, err := tx1.PrefixScan(ctx, []byte("k"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != 2 || string(kvs[0].Key) != "k2" || string(kvs[1].Key) != "k3" {
+		t.Fatal("own writes not merged", kvs)
+	}
+
+	tx2 := lm.MakeTwoPLInstance(store)
+	if err = tx2.Put(ctx, []byte("k4"), []byte{4}); err != ErrLockConflict {
+		t.Fatal("phantom insert granted", err)
+	}
+	tx3 := lm.MakeTwoPLInstance(store)
+	if err = tx3.Put(ctx, []byte("m2"), []byte{4}); err != nil {
+		t.Fatal("insert outside the scanned range blocked", err)
+	}
+	tx3.Commit()
+
+	tx4 := lm.MakeTwoPLInstance(store)
+	if _, err = tx4.Scan(ctx, []byte("k"), []byte("l")); err != ErrLockConflict {
+		t.Fatal("scan over pending writes granted", err)
+	}
+
+	tx1.Commit()
+	tx5 := lm.MakeTwoPLInstance(store)
+	kvs, _ = tx5.Scan(ctx, []byte("k"), nil)
+	if len(kvs) != 4 || string(kvs[3].Key) != "m2" {
+		t.Fatal("bad scan after commit", kvs)
+	}
+	tx5.Commit()
+}
+
+func TestCommitHooks(t *testing.T) {
+	store := storage.MakeNaiveStorage()
+	lm := MakeLockManager(LockPolicyNoWait)
+	lm.Hooks = &Hooks{}
+
+	committed := make([][]byte, 0)
+	lm.Hooks.OnPostCommit(func(keys [][]byte) {
+		committed = append(committed, keys...)
+	})
+	lm.Hooks.OnPreCommit(func(tx Transaction, writes []storage.KV) error {
+		if len(writes) == 0 {
+			return nil
+		}
+		return tx.Put(ctx, []byte("audit"), writes[0].Key)
+	})
+
+	tx1 := lm.MakeTwoPLInstance(store)
+	tx1.Put(ctx, []byte("A"), []byte{1})
+	if err := tx1.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := store.Get([]byte("audit")); string(v) != "A" {
+		t.Error("write of pre-commit hook lost", v)
+	}
+	if len(committed) != 2 {
+		t.Error("bad post-commit keys", committed)
+	}
+
+	committed = committed[:0]
+	tx3 := lm.MakeTwoPLInstance(store)
+	tx3.GetForUpdate(ctx, []byte("B"))
+	tx3.Put(ctx, []byte("C"), []byte{3})
+	if err := tx3.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range committed {
+		if string(key) == "B" {
+			t.Error("key only read for update passed to post-commit hooks", committed)
+		}
+	}
 
+	veto := errors.New("veto")
+	tx2 := lm.MakeTwoPLInstance(store)
+	tx2.OnPreCommit(func(tx Transaction, writes []storage.KV) error {
+		return veto
+	})
+	tx2.OnPostCommit(func(keys [][]byte) {
+		t.Error("post-commit hook of vetoed transaction ran")
+	})
+	tx2.Put(ctx, []byte("A"), []byte{2})
+	if err := tx2.Commit(); err != veto || tx2.State != TxStateAborted {
+		t.Fatal("commit not vetoed", err)
+	}
+	if v, _ := store.Get([]byte("A")); v[0] != 1 {
+		t.Error("vetoed write applied", v)
+	}
+	if len(lm.Locks) != 0 {
+		t.Error("locks of vetoed transaction kept", lm.Locks)
+	}
 }
@@ -0,0 +1,78 @@
+package transaction
+
+import "github.com/Al0ha0e/skv/storage"
+
+// txLog writes the changes a transaction makes to its View ahead to the
+// store's transaction log. The begin record is only written with the first
+// change, so transactions that never write leave nothing in the log.
+type txLog struct {
+	store   storage.Storage
+	id      TxID
+	begun   bool
+	written map[string]bool // keys whose latest record is a write
+}
+
+func (log *txLog) write(key string, value []byte) (err error) {
+	log.store.Lock()
+	defer log.store.Unlock()
+	if !log.begun {
+		if err = log.store.LogBegin(log.id); err != nil {
+			return err
+		}
+		log.begun = true
+		log.written = make(map[string]bool)
+	}
+	if err = log.store.LogWrite(log.id, storage.KV{Key: []byte(key), Value: value}); err != nil {
+		return err
+	}
+	log.written[key] = true
+	return nil
+}
+
+// restore logs the writes a rollback to a savepoint put back. Keys that
+// were not written before the savepoint are taken back out, even when the
+// View still holds a value read for them.
+func (log *txLog) restore(records []undoRecord) (err error) {
+	log.store.Lock()
+	defer log.store.Unlock()
+	for _, rec := range records {
+		if rec.Written {
+			err = log.store.LogWrite(log.id, storage.KV{Key: []byte(rec.Key), Value: rec.Value})
+		} else {
+			err = log.store.LogUnwrite(log.id, []byte(rec.Key))
+			delete(log.written, rec.Key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writes returns the logged writes with their values in view, the changes
+// a commit has to apply.
+func (log *txLog) writes(view map[string][]byte) []storage.KV {
+	kvs := make([]storage.KV, 0, len(log.written))
+	for k := range log.written {
+		kvs = append(kvs, storage.KV{Key: []byte(k), Value: view[k]})
+	}
+	return kvs
+}
+
+// commit logs the commit record stamped with ts and applies kvs. It expects
+// the store to be locked by the caller.
+func (log *txLog) commit(ts uint64, kvs []storage.KV) error {
+	if !log.begun {
+		return nil
+	}
+	return log.store.CommitTx(log.id, ts, kvs)
+}
+
+func (log *txLog) abort() {
+	if !log.begun {
+		return
+	}
+	log.store.Lock()
+	log.store.LogAbort(log.id)
+	log.store.Unlock()
+}
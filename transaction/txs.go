@@ -1,14 +1,76 @@
 package transaction
 
+import (
+	"context"
+	"errors"
+
+	"github.com/Al0ha0e/skv/storage"
+)
+
+var (
+	ErrNotRunning    = errors.New("tx not running")
+	ErrLockConflict  = errors.New("lock conflict")
+	ErrDeadlock      = errors.New("deadlock")
+	ErrDie           = errors.New("younger transaction died")
+	ErrWounded       = errors.New("wounded by older transaction")
+	ErrLockTimeout   = errors.New("lock wait timeout")
+	ErrTxTimeout     = errors.New("transaction timeout")
+	ErrSerialization = errors.New("serialization failure")
+	ErrBadIsolation  = errors.New("unknown isolation level")
+	ErrReadOnlyTx    = errors.New("write in read-only transaction")
+	ErrNoSavepoint   = errors.New("no such savepoint")
+	ErrTSExhausted   = errors.New("timestamps exhausted")
+	ErrFutureTS      = errors.New("timestamp in the future")
+)
+
+// Retryable tells whether err aborted a transaction only because of the
+// transactions running alongside it, so running it again may succeed.
+func Retryable(err error) bool {
+	for _, target := range []error{ErrLockConflict, ErrDeadlock, ErrDie, ErrWounded, ErrLockTimeout, ErrSerialization} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
 type Transaction interface {
-	Get(key []byte) (value []byte, err error)
-	GetForUpdate(key []byte) (value []byte, err error)
-	Put(key []byte, value []byte) (err error)
-	Increase32(key []byte, value int32) (err error)
-	// PutBatch(kvs []storage.KV) (err error)
-	Delete(key []byte) (err error)
+	Get(ctx context.Context, key []byte) (value []byte, err error)
+	GetForUpdate(ctx context.Context, key []byte) (value []byte, err error)
+	Put(ctx context.Context, key []byte, value []byte) (err error)
+	Increase32(ctx context.Context, key []byte, value int32) (err error)
+	PutBatch(ctx context.Context, kvs []storage.KV) (err error)
+	Delete(ctx context.Context, key []byte) (err error)
+	Scan(ctx context.Context, start []byte, end []byte) (kvs []storage.KV, err error)
+	// ScanLimit is Scan stopping after the first limit pairs, 0 for no limit
+	ScanLimit(ctx context.Context, start []byte, end []byte, limit int) (kvs []storage.KV, err error)
+	PrefixScan(ctx context.Context, prefix []byte) (kvs []storage.KV, err error)
+	Savepoint(name string) (err error)
+	RollbackTo(name string) (err error)
 	Commit() (err error)
 	Abort() (err error)
+	OnPreCommit(fn PreCommitHook)
+	OnPostCommit(fn PostCommitHook)
+}
+
+type IsolationLevel = int
+
+// The zero value keeps the strict two-phase locking transactions have always
+// used. Serializable and repeatable read only differ once range reads are
+// involved: only serializable locks the ranges it scans. Snapshot reads the
+// versions committed before it started and lets the first committer of a key
+// win; as it never checks what it read, write skew is possible.
+const (
+	IsolationSerializable IsolationLevel = iota
+	IsolationRepeatableRead
+	IsolationReadCommitted
+	IsolationSnapshot
+)
+
+type TxOptions struct {
+	Isolation IsolationLevel
+	ReadOnly  bool
+	AsOf      uint64 // pins a read-only transaction to this past timestamp
 }
 
 type TxState = int